@@ -10,8 +10,9 @@ import (
 // An interface that defines work to be run on a thread.
 type Work interface {
 	// While the benchmark is running, Do is called repeatedly.
-	// The function is responsible for sending results over the channel.
-	Do(c chan<- interface{})
+	// The function is responsible for adding its results to the Recorder,
+	// which belongs to the thread running the Work.
+	Do(r *Recorder)
 	// Cleanup any state needed before closing the benchmark.
 	Close()
 }
@@ -64,7 +65,7 @@ func (o *operationGater) gateOperations(w WorkInfo) {
 
 // run a WorkInfo repeatedly until we get a message over the
 // quitChannel telling us to exit
-func runTimeBasedWorker(w WorkInfo, metrics chan<- interface{}, quitChannel chan int, done *sync.WaitGroup) {
+func runTimeBasedWorker(w WorkInfo, r *Recorder, quitChannel chan int, done *sync.WaitGroup) {
 	// this should never happen, as we've already called verifyWorks,
 	// but it doesn't hurt
 	if w.MaxOps > 0 {
@@ -78,7 +79,9 @@ func runTimeBasedWorker(w WorkInfo, metrics chan<- interface{}, quitChannel chan
 		case <-quitChannel: // I hope this check is not too inefficient. If it is, we can batch the default case
 			return
 		default:
-			w.Work.Do(metrics)
+			t := time.Now()
+			w.Work.Do(r)
+			r.latencies.Record(time.Since(t))
 		}
 		o.gateOperations(w)
 	}
@@ -87,7 +90,7 @@ func runTimeBasedWorker(w WorkInfo, metrics chan<- interface{}, quitChannel chan
 // run a WorkInfo for a finite number of operations. There is no way
 // to get this function to exit early. It exits once the w.Work has
 // been executed w.MaxOps times
-func runFiniteWorker(w WorkInfo, metrics chan<- interface{}, done *sync.WaitGroup) {
+func runFiniteWorker(w WorkInfo, r *Recorder, done *sync.WaitGroup) {
 	// this should never happen, as we've already called verifyWorks,
 	// but it doesn't hurt
 	if w.MaxOps <= 0 {
@@ -97,7 +100,9 @@ func runFiniteWorker(w WorkInfo, metrics chan<- interface{}, done *sync.WaitGrou
 	defer w.Work.Close()
 	o := operationGater{t0: time.Now()}
 	for numOps := uint64(0); numOps < w.MaxOps; numOps++ {
-		w.Work.Do(metrics)
+		t := time.Now()
+		w.Work.Do(r)
+		r.latencies.Record(time.Since(t))
 		o.gateOperations(w)
 	}
 }
@@ -127,32 +132,56 @@ func verifyWorks(works []WorkInfo, d time.Duration) {
 // If d > 0, the benchmark will run for the time defined by d. If d is 0, then the benchmark is designed
 // to finish a finite amount of work (like loading 10M documents into a collection), and not designed
 // to run for a certain amount of time. As a result, each element of works will have MaxOps > 0.
+// When the benchmark ends, the latencies of the calls to Work.Do are logged.
 func Run(metricSample interface{}, works []WorkInfo, d time.Duration) {
+	latencies := run(metricSample, works, d)
+	log.Println("latencies: ", latencies)
+}
+
+// does the work of Run, returning the latencies of all the calls to Work.Do
+// made by the workers
+func run(metricSample interface{}, works []WorkInfo, d time.Duration) *LatencyHistogram {
 	verifyWorks(works, d)
 	numWorkers := len(works)
 	log.Println("num workers ", numWorkers)
 	workersDone := sync.WaitGroup{}
-	// this channel is used to communicate results
-	metrics := make(chan interface{}, 100)
+	// this channel is used to communicate results to the reporter,
+	// once per snapshotInterval
+	metrics := make(chan interface{}, 1)
 	reporter := olbermann.Reporter{C: metrics}
 	go reporter.Feed()
 	if err := reporter.Start(metricSample, &olbermann.BasicDstatStyler); err != nil {
 		log.Fatal(err)
 	}
 	defer reporter.Close()
+	if *clientStatsInterval > 0 {
+		monitor := startClientMonitor(*clientStatsInterval)
+		defer monitor.stop()
+	}
+	if p := startProfiler(); p != nil {
+		defer p.stop()
+	}
 	// probably a better way to do this
 	quitWorkerChannels := make([]chan int, numWorkers)
 	for i := 0; i < numWorkers; i++ {
 		quitWorkerChannels[i] = make(chan int)
 	}
+	// each worker records its results in its own Recorder so they do not contend
+	layout := newSampleLayout(metricSample)
+	recorders := make([]*Recorder, numWorkers)
+	for i := range recorders {
+		recorders[i] = newRecorder(layout)
+	}
+	started := startMonitors()
+	snapshots := startSnapshotter(layout, recorders, metrics, started)
 	for i := 0; i < numWorkers; i++ {
 		workersDone.Add(1)
 		// MaxOps <= 0 means we will be running for a certain amount of time
 		// and that there is no maximum
 		if works[i].MaxOps <= 0 {
-			go runTimeBasedWorker(works[i], metrics, quitWorkerChannels[i], &workersDone)
+			go runTimeBasedWorker(works[i], recorders[i], quitWorkerChannels[i], &workersDone)
 		} else {
-			go runFiniteWorker(works[i], metrics, &workersDone)
+			go runFiniteWorker(works[i], recorders[i], &workersDone)
 		}
 	}
 	time.Sleep(d)
@@ -162,4 +191,11 @@ func Run(metricSample interface{}, works []WorkInfo, d time.Duration) {
 		}
 	}
 	workersDone.Wait()
+	snapshots.stop()
+	stopMonitors(started)
+	total := new(LatencyHistogram)
+	for _, r := range recorders {
+		total.Merge(&r.latencies)
+	}
+	return total
 }
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/Tokutek/go-benchmark/mongotools"
 	"labix.org/v2/mgo"
-	"log"
 )
 
 func main() {
@@ -17,12 +16,9 @@ func main() {
 
 	// will hard code 3 indexes.
 	flag.Parse()
-	session, err := mgo.Dial(*host)
-	if err != nil {
-		log.Fatal("Error connecting to ", *host, ": ", err)
-	}
-	// so we are not in fire and forget
-	session.SetSafe(&mgo.Safe{})
+	// connects as given on the command line, with the write concern,
+	// read preference and timeouts given there
+	session := mongotools.Dial(*host)
 	defer session.Close()
 
 	// these are dummy indexes. We are not inserting data
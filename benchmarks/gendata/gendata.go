@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"github.com/Tokutek/go-benchmark/benchmarks/iibench"
+	"github.com/Tokutek/go-benchmark/benchmarks/schema"
+	"github.com/Tokutek/go-benchmark/benchmarks/sysbench"
+	"github.com/Tokutek/go-benchmark/mongotools"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// writes a dataset file of the documents of a benchmark, for the -datasetFile
+// flag of its loader to insert, so that the same documents are loaded into every server
+func main() {
+	benchmarkName := flag.String("benchmark", "iibench", "benchmark whose documents to generate: \"iibench\", \"sysbench\", or \"schema\" for those -schemaFile describes")
+	schemaFile := flag.String("schemaFile", "", "JSON or YAML file describing the documents to generate, for -benchmark schema. See package schema")
+	numDocs := flag.Int("numDocs", 1000000, "number of documents to generate")
+	output := flag.String("output", "", "file to write the documents to")
+	format := flag.String("format", "", "format of the file: \"bson\" or \"json\" (one document of extended JSON per line). Defaults to \"json\" for .json and .jsonl files, \"bson\" otherwise. Loading a file whose format is not the one of its extension needs -datasetFormat")
+	seed := flag.Int64("seed", 0, "seed of the random numbers of the documents, so that a dataset can be generated again. 0 means one based on the time")
+	flag.Parse()
+
+	if *output == "" {
+		log.Fatal("-output must be set")
+	}
+	if *format == "" {
+		*format = mongotools.DatasetFormat(*output)
+	} else if *format != "bson" && *format != "json" {
+		log.Fatal("invalid value for format: ", *format)
+	} else if *format != mongotools.DatasetFormat(*output) {
+		log.Println("the format of ", *output, " is not the one of its extension, so it must be loaded with -datasetFormat ", *format)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	var gen mongotools.DocGenerator
+	switch *benchmarkName {
+	case "iibench":
+		gen = iibench.NewDocGenerator().Split(0, 1, *seed)
+	case "sysbench":
+		gen = sysbench.NewDocGenerator(rand.New(rand.NewSource(*seed)))
+	case "schema":
+		if *schemaFile == "" {
+			log.Fatal("-schemaFile must be set for -benchmark schema")
+		}
+		s, err := schema.LoadSchema(*schemaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gen = s.NewDocGenerator(rand.New(rand.NewSource(*seed)))
+	default:
+		log.Fatal("invalid value for benchmark: ", *benchmarkName)
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		log.Fatal("Error creating ", *output, ": ", err)
+	}
+	defer f.Close()
+	if err = mongotools.WriteDataset(f, gen, *numDocs, *format); err != nil {
+		log.Fatal("Error writing ", *output, ": ", err)
+	}
+	log.Println("wrote ", *numDocs, " documents to ", *output, " with seed ", *seed)
+}
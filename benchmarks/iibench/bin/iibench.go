@@ -7,6 +7,8 @@ import (
 	"github.com/Tokutek/go-benchmark/mongotools"
 	"labix.org/v2/mgo"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,12 +17,20 @@ var (
 	dbname         = flag.String("db", "iibench", "dbname")
 	collname       = flag.String("coll", "purchases_index", "collname")
 	numCollections = flag.Int("numCollections", 1, "number of collections to simultaneously run on")
+	tsPrimaryKey   = flag.Bool("tsPrimaryKey", false, "if true, cluster the collections on {ts: 1, _id: 1} instead of _id when creating them (TokuMX only)")
+
+	// for mixing index configurations when creating the collections (TokuMX only)
+	clusteringIndexes = flag.String("clusteringIndexes", "", "comma separated positions of the secondary indexes to make clustering, 0 being {pr, cid}, 1 being {crid, pr, cid} and 2 being {pr, ts, cid}")
+	indexCompression  = flag.String("indexCompression", "", "comma separated compression of each secondary index, by position as in -clusteringIndexes. Empty values use -compression, e.g. \",quicklz,lzma\"")
 
 	// for benchmark
 	numWriters          = flag.Int("numWriterThreads", 1, "specify the number of writer threads")
 	numQueryThreads     = flag.Int("numQueryThreads", 0, "specify the number of threads to perform queries")
 	numSeconds          = flag.Int64("numSeconds", 3600, "number of seconds the benchmark is to run. If this value is > 0, then numInsertsPerThread MUST be 0, and vice versa")
 	numInsertsPerThread = flag.Int("numInsertsPerThread", 0, "number of inserts to be done per thread. If this value is > 0, then numSeconds MUST be 0 and numQueryThreads MUST be 0")
+	datasetFile         = flag.String("datasetFile", "", "if set, dataset file (see gendata) whose documents each writer inserts, instead of generating them, so -numCharFields and -charFieldLength do not apply")
+	datasetFormat       = flag.String("datasetFormat", "", "format of -datasetFile: \"bson\" or \"json\". Defaults to the one of its extension, as gendata's -format")
+	datasetReplay       = flag.Bool("datasetReplay", false, "if true, a writer that inserted all documents of -datasetFile inserts them again from the first, which only works for documents without _id. Otherwise running out of documents is fatal")
 )
 
 func main() {
@@ -30,29 +40,55 @@ func main() {
 		log.Fatal("Invalid values for numInsertsPerThread: ", *numInsertsPerThread, ", numQueryThreads: ", *numQueryThreads, ", numSeconds: ", *numSeconds)
 	}
 
-	session, err := mgo.Dial(*host)
-	if err != nil {
-		log.Fatal("Error connecting to ", *host, ": ", err)
-	}
-	// so we are not in fire and forget
-	session.SetSafe(&mgo.Safe{})
+	// connects as given on the command line, with the write concern,
+	// read preference and timeouts given there
+	session := mongotools.Dial(*host)
 	defer session.Close()
+	// samples the status of the server during the run, see -serverStatusInterval
+	mongotools.MonitorServerStatus(session)
 
-	indexes := make([]mgo.Index, 3)
-	indexes[0] = mgo.Index{Key: []string{"pr", "cid"}}
-	indexes[1] = mgo.Index{Key: []string{"crid", "pr", "cid"}}
-	indexes[2] = mgo.Index{Key: []string{"pr", "ts", "cid"}}
+	indexes := mongotools.IndexSpecs(
+		mgo.Index{Key: []string{"pr", "cid"}},
+		mgo.Index{Key: []string{"crid", "pr", "cid"}},
+		mgo.Index{Key: []string{"pr", "ts", "cid"}})
+	if *clusteringIndexes != "" {
+		for _, pos := range strings.Split(*clusteringIndexes, ",") {
+			i, err := strconv.Atoi(pos)
+			if err != nil || i < 0 || i >= len(indexes) {
+				log.Fatal("invalid value for clusteringIndexes: ", *clusteringIndexes)
+			}
+			indexes[i].Clustering = true
+		}
+	}
+	if *indexCompression != "" {
+		compressions := strings.Split(*indexCompression, ",")
+		if len(compressions) > len(indexes) {
+			log.Fatal("invalid value for indexCompression: ", *indexCompression)
+		}
+		for i := range compressions {
+			indexes[i].Compression = compressions[i]
+		}
+	}
 
-	mongotools.MakeCollections(*collname, *dbname, *numCollections, session, indexes)
+	options := mongotools.CollectionOptions{Indexes: indexes}
+	if *tsPrimaryKey {
+		options.PrimaryKey = iibench.TimestampPrimaryKey
+	}
+	mongotools.MakeCollectionsWithOptions(*collname, *dbname, *numCollections, session, options)
 	// at this point we have created the collection, now run the benchmark
 	res := new(iibench.Result)
 	workers := make([]benchmark.WorkInfo, 0, *numWriters+*numQueryThreads)
 	for i := 0; i < *numWriters; i++ {
 		copiedSession := session.Copy()
 		defer copiedSession.Close()
-		var gen = iibench.NewDocGenerator()
+		var gen mongotools.DocGenerator = iibench.NewDocGenerator()
+		if *datasetFile != "" {
+			fileGen := mongotools.NewFileDocGenerator(*datasetFile, *datasetFormat, *datasetReplay)
+			defer fileGen.Close()
+			gen = fileGen
+		}
 		currCollectionString := mongotools.GetCollectionString(*collname, i%*numCollections)
-		workers = append(workers, mongotools.NewInsertWork(gen, copiedSession.DB(*dbname).C(currCollectionString), *numInsertsPerThread))
+		workers = append(workers, mongotools.NewInsertWork(gen, copiedSession.DB(*dbname).C(currCollectionString), mongotools.InsertOptionsFromFlags(*numInsertsPerThread)))
 	}
 	for i := 0; i < *numQueryThreads; i++ {
 		currCollectionString := mongotools.GetCollectionString(*collname, i%*numCollections)
@@ -3,6 +3,8 @@ package iibench
 import (
 	"flag"
 	"github.com/Tokutek/go-benchmark"
+	"github.com/Tokutek/go-benchmark/distributions"
+	"github.com/Tokutek/go-benchmark/mongotools"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"math/rand"
@@ -16,6 +18,10 @@ const (
 	MaxPrice            = 500.0
 )
 
+// The primary key to cluster iibench collections on to keep documents in
+// insertion order, as an alternative to the default of _id (TokuMX only)
+var TimestampPrimaryKey = []string{"ts", "_id"}
+
 var (
 	// for QueryWork
 	queryResultLimit   = flag.Int("queryResultLimit", 10, "number of results queries should be limited to")
@@ -57,6 +63,12 @@ func NewDocGenerator() *DocGenerator {
 	return &DocGenerator{randSource: rand.New(rand.NewSource(time.Now().UnixNano())), NumCharFields: *numCharFields, CharFieldLength: *charFieldLength}
 }
 
+// returns the generator of thread i of n generating iibench documents, which draws
+// its random numbers from a source seeded with seed. Implements mongotools.ParallelDocGenerator
+func (g *DocGenerator) Split(i int, n int, seed int64) mongotools.DocGenerator {
+	return &DocGenerator{randSource: rand.New(rand.NewSource(seed)), NumCharFields: g.NumCharFields, CharFieldLength: g.CharFieldLength}
+}
+
 // function to generate an iiBench document
 func (g *DocGenerator) Generate() interface{} {
 	dateAndTime := time.Now()
@@ -89,6 +101,8 @@ func (g *DocGenerator) Generate() interface{} {
 type QueryWork struct {
 	coll            *mgo.Collection
 	randSource      *rand.Rand
+	customers       distributions.Distribution // chooses the customers queried
+	cashRegisters   distributions.Distribution // chooses the cash registers queried
 	startTime       time.Time
 	numQueriesSoFar uint64
 }
@@ -98,16 +112,30 @@ type QueryWork struct {
 type Result struct {
 	NumInserts uint64 `type:"counter" report:"iter,cum,total"`
 	NumQueries uint64 `type:"counter" report:"iter,cum,total"`
+	NumRetries uint64 `type:"counter" report:"total"`
+	// operations other than inserts, of benchmarks that mix them into their
+	// batches (see mongotools.OpGenerator), and the operations that failed.
+	// See mongotools.InsertResult
+	NumUpdates   uint64 `type:"counter" report:"total"`
+	NumUpserts   uint64 `type:"counter" report:"total"`
+	NumDeletes   uint64 `type:"counter" report:"total"`
+	NumFailedOps uint64 `type:"counter" report:"total"`
 }
 
 func NewQueryWork(s *mgo.Session, db string, coll string) benchmark.WorkInfo {
-	qw := &QueryWork{coll: s.DB(db).C(coll), randSource: rand.New(rand.NewSource(time.Now().UnixNano())), startTime: time.Now()}
+	randSource := rand.New(rand.NewSource(time.Now().UnixNano()))
+	qw := &QueryWork{
+		coll:          s.DB(db).C(coll),
+		randSource:    randSource,
+		customers:     distributions.NewFromFlags(randSource, MaxNumCustomers),
+		cashRegisters: distributions.NewFromFlags(randSource, MaxNumCashRegisters),
+		startTime:     time.Now()}
 	return benchmark.WorkInfo{qw, *queriesPerInterval, *queryInterval, 0}
 }
 
-func (qw *QueryWork) Do(c chan<- interface{}) {
-	customerID := qw.randSource.Int31n(MaxNumCustomers)
-	cashRegisterID := qw.randSource.Int31n(MaxNumCashRegisters)
+func (qw *QueryWork) Do(r *benchmark.Recorder) {
+	customerID := int32(qw.customers.Next(MaxNumCustomers))
+	cashRegisterID := int32(qw.cashRegisters.Next(MaxNumCashRegisters))
 	price := qw.randSource.Float64()*MaxPrice + float64(customerID)/100.0
 	// generate a random time since qw.StartTime
 	// there is likely a better way to do this
@@ -147,7 +175,7 @@ func (qw *QueryWork) Do(c chan<- interface{}) {
 	for iter.Next(&result) {
 	}
 	qw.numQueriesSoFar++
-	c <- Result{NumQueries: 1}
+	r.Add(Result{NumQueries: 1})
 }
 
 func (qw *QueryWork) Close() {
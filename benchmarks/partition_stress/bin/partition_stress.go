@@ -7,7 +7,6 @@ import (
 	"github.com/Tokutek/go-benchmark/benchmarks/partition_stress"
 	"github.com/Tokutek/go-benchmark/mongotools"
 	"labix.org/v2/mgo"
-	"log"
 	"time"
 )
 
@@ -19,13 +18,12 @@ func main() {
 
 	flag.Parse()
 
-	session, err := mgo.Dial(*host)
-	if err != nil {
-		log.Fatal("Error connecting to ", *host, ": ", err)
-	}
-	// so we are not in fire and forget
-	session.SetSafe(&mgo.Safe{})
+	// connects as given on the command line, with the write concern,
+	// read preference and timeouts given there
+	session := mongotools.Dial(*host)
 	defer session.Close()
+	// samples the status of the server during the run, see -serverStatusInterval
+	mongotools.MonitorServerStatus(session)
 
 	indexes := make([]mgo.Index, 3)
 	indexes[0] = mgo.Index{Key: []string{"pr", "cid"}}
@@ -45,7 +43,7 @@ func main() {
 		var gen = iibench.NewDocGenerator()
 		gen.CharFieldLength = 100
 		gen.NumCharFields = 0
-		workers = append(workers, mongotools.NewInsertWork(gen, copiedSession.DB(dbname).C(currCollectionString), 0))
+		workers = append(workers, mongotools.NewInsertWork(gen, copiedSession.DB(dbname).C(currCollectionString), mongotools.InsertOptionsFromFlags(0)))
 	}
 	for i := 0; i < numQueryThreads; i++ {
 		copiedSession := session.Copy()
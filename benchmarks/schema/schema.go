@@ -0,0 +1,318 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Tokutek/go-benchmark/benchmarks/sysbench"
+	"github.com/Tokutek/go-benchmark/mongotools"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"labix.org/v2/mgo/bson"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// A Schema describes the documents of a benchmark as a list of fields and how the value
+// of each is generated, so that documents of any shape can be generated without code.
+// Schemas are read from JSON or YAML files, for instance:
+//
+//     {"fields": [
+//         {"name": "_id", "type": "sequence"},
+//         {"name": "k", "type": "int", "distribution": "zipf", "max": 1000000},
+//         {"name": "c", "type": "string", "template": "###########-@@@@@@@@@@@"},
+//         {"name": "ts", "type": "timestamp"},
+//         {"name": "tags", "type": "array", "count": 3, "element": {"type": "string", "length": 8}},
+//         {"name": "owner", "type": "object", "fields": [{"name": "id", "type": "int", "max": 100}]}
+//     ]}
+//
+// The types of fields are:
+//
+// "sequence": integers counting up from "start" (default 0)
+//
+// "int": random integers between "min" and "max", inclusive (default 0 and 2^31-1), with "distribution"
+// "uniform" (the default) or "zipf", for which "s" (default 1.1, must be > 1) is the exponent,
+// and the smallest values are the most frequent
+//
+// "string": random strings, either of "template", in which '#' stands for a random digit
+// and '@' for a random letter as in sysbench's strings, or of "length" random letters
+//
+// "timestamp": the time the document is generated, or with "start" and "end" (RFC 3339),
+// a random time between them
+//
+// "object": a nested document, of "fields"
+//
+// "array": an array of "count" values generated as "element" describes
+//
+// "constant": always "value"
+type Schema struct {
+	Fields []Field `json:"fields" yaml:"fields"`
+}
+
+// A Field of a Schema. Which members apply depends on the Type, see Schema
+type Field struct {
+	Name         string      `json:"name" yaml:"name"`
+	Type         string      `json:"type" yaml:"type"`
+	Start        interface{} `json:"start" yaml:"start"`
+	End          string      `json:"end" yaml:"end"`
+	Min          *int64      `json:"min" yaml:"min"`
+	Max          *int64      `json:"max" yaml:"max"`
+	Distribution string      `json:"distribution" yaml:"distribution"`
+	S            float64     `json:"s" yaml:"s"`
+	Template     string      `json:"template" yaml:"template"`
+	Length       int         `json:"length" yaml:"length"`
+	Fields       []Field     `json:"fields" yaml:"fields"`
+	Count        int         `json:"count" yaml:"count"`
+	Element      *Field      `json:"element" yaml:"element"`
+	Value        interface{} `json:"value" yaml:"value"`
+}
+
+// LoadSchema reads the schema in the file at path, which is YAML if its
+// extension is .yaml or .yml, and JSON otherwise
+func LoadSchema(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := new(Schema)
+	// strict, so that a misspelled member is an error rather than silently ignored
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		err = yaml.UnmarshalStrict(data, s)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing schema %s: %v", path, err)
+	}
+	// so that a schema with errors fails here, not when generating documents
+	if _, err = s.compile(rand.New(rand.NewSource(0)), 0, 1); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// generates the value of a field
+type valueGen func() interface{}
+
+// a field and the generator of its values
+type compiledField struct {
+	name string
+	gen  valueGen
+}
+
+// returns the generators of the fields of s, drawing their random numbers from r.
+// Sequences start at their start plus offset, and increase by stride
+func (s *Schema) compile(r *rand.Rand, offset int64, stride int64) ([]compiledField, error) {
+	return compileFields(s.Fields, r, offset, stride)
+}
+
+func compileFields(fields []Field, r *rand.Rand, offset int64, stride int64) ([]compiledField, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("no fields")
+	}
+	ret := make([]compiledField, len(fields))
+	for i, f := range fields {
+		if f.Name == "" {
+			return nil, fmt.Errorf("field %d has no name", i)
+		}
+		gen, err := compileField(f, r, offset, stride)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+		ret[i] = compiledField{f.Name, gen}
+	}
+	return ret, nil
+}
+
+// returns the generator of the values of f
+func compileField(f Field, r *rand.Rand, offset int64, stride int64) (valueGen, error) {
+	switch f.Type {
+	case "sequence":
+		var start int64
+		switch x := f.Start.(type) {
+		case nil:
+		case float64:
+			start = int64(x)
+		case int:
+			start = int64(x)
+		default:
+			return nil, errors.New("start of a sequence must be an integer")
+		}
+		next := start + offset
+		return func() interface{} {
+			ret := next
+			next += stride
+			return ret
+		}, nil
+	case "int":
+		var min, max int64 = 0, 1<<31 - 1
+		if f.Min != nil {
+			min = *f.Min
+		}
+		if f.Max != nil {
+			max = *f.Max
+		}
+		if max < min {
+			return nil, errors.New("max is less than min")
+		}
+		if max-min < 0 || max-min == math.MaxInt64 {
+			// the number of values does not fit in an int64
+			return nil, errors.New("the range from min to max is too large")
+		}
+		switch f.Distribution {
+		case "", "uniform":
+			return func() interface{} {
+				return min + r.Int63n(max-min+1)
+			}, nil
+		case "zipf":
+			s := f.S
+			if s == 0 {
+				s = 1.1
+			}
+			if s <= 1 {
+				return nil, errors.New("s must be greater than 1")
+			}
+			zipf := rand.NewZipf(r, s, 1, uint64(max-min))
+			return func() interface{} {
+				return min + int64(zipf.Uint64())
+			}, nil
+		}
+		return nil, errors.New("invalid distribution " + f.Distribution)
+	case "string":
+		if f.Template != "" {
+			template := f.Template
+			return func() interface{} {
+				return sysbench.GenString(template, r)
+			}, nil
+		}
+		if f.Length <= 0 {
+			return nil, errors.New("a string needs a template or a length")
+		}
+		template := strings.Repeat("@", f.Length)
+		return func() interface{} {
+			return sysbench.GenString(template, r)
+		}, nil
+	case "timestamp":
+		if f.Start == nil && f.End == "" {
+			return func() interface{} {
+				return time.Now()
+			}, nil
+		}
+		startStr, _ := f.Start.(string)
+		start, err := time.Parse(time.RFC3339, startStr)
+		if err != nil {
+			return nil, errors.New("invalid start: " + err.Error())
+		}
+		end, err := time.Parse(time.RFC3339, f.End)
+		if err != nil {
+			return nil, errors.New("invalid end: " + err.Error())
+		}
+		span := end.Sub(start)
+		if span <= 0 {
+			return nil, errors.New("end must be after start")
+		}
+		return func() interface{} {
+			return start.Add(time.Duration(r.Int63n(int64(span))))
+		}, nil
+	case "object":
+		fields, err := compileFields(f.Fields, r, offset, stride)
+		if err != nil {
+			return nil, err
+		}
+		return func() interface{} {
+			return generateDoc(fields)
+		}, nil
+	case "array":
+		if f.Element == nil || f.Count < 0 {
+			return nil, errors.New("an array needs an element and a count")
+		}
+		elem, err := compileField(*f.Element, r, offset, stride)
+		if err != nil {
+			return nil, err
+		}
+		count := f.Count
+		return func() interface{} {
+			arr := make([]interface{}, count)
+			for i := range arr {
+				arr[i] = elem()
+			}
+			return arr
+		}, nil
+	case "constant":
+		value := normalizeValue(f.Value)
+		return func() interface{} {
+			return value
+		}, nil
+	}
+	return nil, errors.New("invalid type " + f.Type)
+}
+
+// converts the maps YAML decodes documents into, which BSON cannot marshal, into bson.M
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(bson.M, len(x))
+		for k, elem := range x {
+			m[fmt.Sprint(k)] = normalizeValue(elem)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(bson.M, len(x))
+		for k, elem := range x {
+			m[k] = normalizeValue(elem)
+		}
+		return m
+	case []interface{}:
+		arr := make([]interface{}, len(x))
+		for i := range x {
+			arr[i] = normalizeValue(x[i])
+		}
+		return arr
+	}
+	return v
+}
+
+func generateDoc(fields []compiledField) bson.D {
+	doc := make(bson.D, len(fields))
+	for i, f := range fields {
+		doc[i] = bson.DocElem{f.name, f.gen()}
+	}
+	return doc
+}
+
+// A DocGenerator generating the documents a Schema describes.
+// Implements mongotools.ParallelDocGenerator
+type DocGenerator struct {
+	schema *Schema
+	fields []compiledField
+}
+
+// returns a DocGenerator of the documents of s, drawing its random numbers from randSource
+func (s *Schema) NewDocGenerator(randSource *rand.Rand) *DocGenerator {
+	return s.newDocGenerator(randSource, 0, 1)
+}
+
+func (s *Schema) newDocGenerator(randSource *rand.Rand, offset int64, stride int64) *DocGenerator {
+	fields, err := s.compile(randSource, offset, stride)
+	if err != nil {
+		// LoadSchema verified the schema compiles
+		panic(err)
+	}
+	return &DocGenerator{s, fields}
+}
+
+// returns the next document, as a bson.D with the fields in the order of the schema
+func (g *DocGenerator) Generate() interface{} {
+	return generateDoc(g.fields)
+}
+
+// returns the generator of thread i of n, whose sequences generate the values
+// that are i modulo n, and whose random numbers are drawn from a source seeded with seed
+func (g *DocGenerator) Split(i int, n int, seed int64) mongotools.DocGenerator {
+	return g.schema.newDocGenerator(rand.New(rand.NewSource(seed)), int64(i), int64(n))
+}
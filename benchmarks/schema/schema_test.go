@@ -0,0 +1,98 @@
+package schema
+
+import (
+	"io/ioutil"
+	"labix.org/v2/mgo/bson"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loads a schema of content from a file named name
+func loadSchema(t *testing.T, name string, content string) (*Schema, error) {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadSchema(path)
+}
+
+func TestMaxZero(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"schema.json", `{"fields": [{"name": "x", "type": "int", "min": -5, "max": 0}]}`},
+		{"schema.yaml", "fields:\n  - {name: x, type: int, min: -5, max: 0}\n"},
+		{"zipf.json", `{"fields": [{"name": "x", "type": "int", "distribution": "zipf", "min": -5, "max": 0}]}`},
+	}
+	for _, test := range tests {
+		s, err := loadSchema(t, test.name, test.content)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		// max 0 must not be taken for an absent max, whose default is 2^31-1
+		if s.Fields[0].Max == nil || *s.Fields[0].Max != 0 {
+			t.Fatalf("%s: max parsed as %v", test.name, s.Fields[0].Max)
+		}
+		gen := s.NewDocGenerator(rand.New(rand.NewSource(1)))
+		seen := make(map[int64]bool)
+		for i := 0; i < 1000; i++ {
+			x := gen.Generate().(bson.D)[0].Value.(int64)
+			if x < -5 || x > 0 {
+				t.Fatalf("%s: value %d out of [-5, 0]", test.name, x)
+			}
+			seen[x] = true
+		}
+		if !seen[0] {
+			t.Errorf("%s: max 0 never generated", test.name)
+		}
+	}
+}
+
+func TestRangeOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		tooLarge bool
+	}{
+		{"full.json", `{"fields": [{"name": "x", "type": "int", "min": -9223372036854775808, "max": 9223372036854775807}]}`, true},
+		{"full.yaml", "fields:\n  - {name: x, type: int, min: -9223372036854775808, max: 9223372036854775807}\n", true},
+		{"half.json", `{"fields": [{"name": "x", "type": "int", "min": -1, "max": 9223372036854775807}]}`, true},
+		{"largest.json", `{"fields": [{"name": "x", "type": "int", "min": 0, "max": 9223372036854775806}]}`, false},
+	}
+	for _, test := range tests {
+		_, err := loadSchema(t, test.name, test.content)
+		if test.tooLarge && (err == nil || !strings.Contains(err.Error(), "too large")) {
+			t.Errorf("%s: got error %v, want the range to be too large", test.name, err)
+		}
+		if !test.tooLarge && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestUnknownKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"schema.json", `{"fields": [{"name": "x", "type": "int", "maxx": 10}]}`},
+		{"schema.yaml", "fields:\n  - {name: x, type: int, maxx: 10}\n"},
+		{"top.json", `{"fields": [{"name": "x", "type": "int"}], "field": []}`},
+		{"top.yml", "fields:\n  - {name: x, type: int}\nfield: []\n"},
+	}
+	for _, test := range tests {
+		_, err := loadSchema(t, test.name, test.content)
+		if err == nil || !strings.Contains(err.Error(), "error parsing schema") {
+			t.Errorf("%s: got error %v, want a parse error", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package sysbench
+
+import (
+	"github.com/Tokutek/go-benchmark/mongotools"
+	"labix.org/v2/mgo/bson"
+	"math/rand"
+)
+
+// generates sysbench documents, with ids counting up from 0. Implements
+// mongotools.ParallelDocGenerator, and mongotools.OpGenerator, mixing in
+// updates, upserts and deletes as its fractions define
+type DocGenerator struct {
+	RandSource *rand.Rand
+	// the fractions of the operations generated by GenerateOp that update, upsert or
+	// delete a random document among those generated so far, instead of inserting one
+	UpdateFraction float64
+	UpsertFraction float64
+	DeleteFraction float64
+	currID         uint64
+	// how much the id increases for each document, 0 meaning 1. Generators
+	// made by Split interleave their ids, so that they have a stride
+	stride uint64
+}
+
+// returns a DocGenerator drawing its random numbers from randSource
+func NewDocGenerator(randSource *rand.Rand) *DocGenerator {
+	return &DocGenerator{RandSource: randSource}
+}
+
+// returns the generator of thread i of n, which generates the documents whose ids,
+// counting from the next id of generator, are i modulo n.
+// Implements mongotools.ParallelDocGenerator
+func (generator *DocGenerator) Split(i int, n int, seed int64) mongotools.DocGenerator {
+	ret := *generator
+	ret.RandSource = rand.New(rand.NewSource(seed))
+	ret.currID = generator.currID + uint64(i)
+	ret.stride = uint64(n)
+	return &ret
+}
+
+func (generator *DocGenerator) Generate() interface{} {
+	ret := Doc{
+		generator.currID,
+		generator.RandSource.Int(),
+		generator.RandSource.Int(),
+		CString(generator.RandSource),
+		PadString(generator.RandSource)}
+	if generator.stride == 0 {
+		generator.currID++
+	} else {
+		generator.currID += generator.stride
+	}
+	return ret
+}
+
+// generates an insert, or an update, upsert or delete of a random document among
+// those generated so far, as the fractions of generator define
+func (generator *DocGenerator) GenerateOp() mongotools.BulkOp {
+	p := generator.RandSource.Float64()
+	if generator.currID == 0 || p >= generator.UpdateFraction+generator.UpsertFraction+generator.DeleteFraction {
+		return mongotools.NewInsertOp(generator.Generate())
+	}
+	selector := bson.M{"_id": uint64(generator.RandSource.Int63n(int64(generator.currID)))}
+	switch {
+	case p < generator.UpdateFraction:
+		return mongotools.NewUpdateOp(selector, bson.M{"$inc": bson.M{"k": 1}})
+	case p < generator.UpdateFraction+generator.UpsertFraction:
+		return mongotools.NewUpsertOp(selector, bson.M{"$set": bson.M{"c": CString(generator.RandSource)}})
+	}
+	return mongotools.NewDeleteOp(selector)
+}
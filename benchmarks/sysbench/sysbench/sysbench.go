@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"github.com/Tokutek/go-benchmark"
 	"github.com/Tokutek/go-benchmark/benchmarks/sysbench"
+	"github.com/Tokutek/go-benchmark/distributions"
 	"github.com/Tokutek/go-benchmark/mongotools"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"log"
 	"math/rand"
+	"os"
 	"time"
 )
 
@@ -34,131 +36,142 @@ type SysbenchTransaction struct {
 	NumCollections int
 	ReadOnly       bool
 	MaxID          int64
+	Retry          mongotools.RetryPolicy
+	Server         *mongotools.ServerInfo
+	// reused by all transactions, so that on MongoDB they run on the same server session
+	Txn *mongotools.Transaction
+	// chooses the ids read and updated, from RandSource
+	Keys distributions.Distribution
 }
 
-func runQuery(filter bson.M, projection bson.M, coll *mgo.Collection) {
-	var result bson.M
-	iter := coll.Find(filter).Select(projection).Iter()
-	for iter.Next(&result) {
-	}
-}
-
-func (s SysbenchTransaction) Do(c chan<- interface{}) {
+func (s SysbenchTransaction) Do(r *benchmark.Recorder) {
 	db := s.Session.DB(s.Dbname)
 	collectionIndex := s.RandSource.Int31n(int32(s.NumCollections))
 	coll := db.C(mongotools.GetCollectionString(s.Collname, int(collectionIndex)))
 	var sbresult SysbenchResult
 
-	txn := mongotools.Transaction{DB: db}
-	if err := txn.Begin(); err != nil {
+	options := mongotools.TransactionOptions{Retry: s.Retry, Server: s.Server, Transaction: s.Txn}
+	txnResult, err := mongotools.RunInTransactionWithOptions(db, options, func(txn *mongotools.Transaction) error {
+		return s.runStatements(txn, coll)
+	})
+	sbresult.NumCommits += txnResult.NumCommits
+	sbresult.NumAborts += txnResult.NumAborts
+	sbresult.NumRetries += txnResult.NumRetries
+	if err != nil {
+		// we got an error we could not retry past, or the commit failed
 		sbresult.NumErrors++
 	}
-	defer txn.Close()
 
+	sbresult.NumTransactions++
+	r.Add(sbresult)
+}
+
+// runs the statements of one attempt of a sysbench transaction on coll, with txn. Returns the
+// error of the first statement that fails, so that the attempt is aborted, and s.Retry decides
+// whether to run another
+func (s SysbenchTransaction) runStatements(txn *mongotools.Transaction, coll *mgo.Collection) error {
 	var i uint
+	var results []bson.M
 	for i = 0; i < s.Info.oltpPointSelects; i++ {
 		// db.sbtest8.find({_id: 554312}, {c: 1, _id: 0})
-		filter := bson.M{"_id": s.RandSource.Int63n(int64(s.MaxID))}
+		filter := bson.M{"_id": s.Keys.Next(s.MaxID)}
 		projection := bson.M{"c": 1}
-		runQuery(filter, projection, coll)
+		err := txn.Find(coll, filter, projection, &results)
+		if err != nil {
+			return err
+		}
 	}
 	for i = 0; i < s.Info.oltpSimpleRanges; i++ {
 		//db.sbtest8.find({_id: {$gte: 5523412, $lte: 5523512}}, {c: 1, _id: 0})
-		startID := s.RandSource.Int63n(s.MaxID)
+		startID := s.Keys.Next(s.MaxID)
 		endID := startID + int64(s.Info.oltpRangeSize)
 		filter := bson.M{"_id": bson.M{"$gte": startID, "$lt": endID}}
 		projection := bson.M{"c": 1}
-		runQuery(filter, projection, coll)
+		err := txn.Find(coll, filter, projection, &results)
+		if err != nil {
+			return err
+		}
 	}
 	for i = 0; i < s.Info.oltpSumRanges; i++ {
 		//db.sbtest8.aggregate([ {$match: {_id: {$gt: 5523412, $lt: 5523512}}}, { $group: { _id: null, total: { $sum: "$k"}} } ])
-		startID := s.RandSource.Int63n(s.MaxID)
+		startID := s.Keys.Next(s.MaxID)
 		endID := startID + int64(s.Info.oltpRangeSize)
 		firstPipe := bson.M{"$match": bson.M{"_id": bson.M{"$gt": startID, "$lt": endID}}}
 		secondPipe := bson.M{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": "$k"}}} // is this $k correct?
-		pipe := coll.Pipe([]bson.M{firstPipe, secondPipe})
-		iter := pipe.Iter()
-		var result bson.M
-		for iter.Next(&result) {
+		err := txn.Aggregate(coll, []bson.M{firstPipe, secondPipe}, &results)
+		if err != nil {
+			return err
 		}
 	}
 	for i = 0; i < s.Info.oltpOrderRanges; i++ {
 		//db.sbtest8.find({_id: {$gte: 5523412, $lte: 5523512}}, {c: 1, _id: 0}).sort({c: 1})
-		startID := s.RandSource.Int63n(s.MaxID)
+		startID := s.Keys.Next(s.MaxID)
 		endID := startID + int64(s.Info.oltpRangeSize)
 		filter := bson.M{"_id": bson.M{"$gte": startID, "$lt": endID}}
 		projection := bson.M{"c": 1}
-		var result bson.M
-		iter := coll.Find(filter).Select(projection).Sort("c").Iter()
-		for iter.Next(&result) {
+		err := txn.Find(coll, filter, projection, &results, "c")
+		if err != nil {
+			return err
 		}
 	}
 	for i = 0; i < s.Info.oltpDistinctRanges; i++ {
 		//db.sbtest8.distinct("c",{_id: {$gt: 5523412, $lt: 5523512}}).sort()
-		startID := s.RandSource.Int63n(s.MaxID)
+		startID := s.Keys.Next(s.MaxID)
 		endID := startID + int64(s.Info.oltpRangeSize)
 		filter := bson.M{"_id": bson.M{"$gte": startID, "$lt": endID}}
 		var distinctResults []string
-		err := coll.Find(filter).Distinct("c", &distinctResults)
+		err := txn.Distinct(coll, "c", filter, &distinctResults)
 		if err != nil {
-			// we got an error
-			sbresult.NumErrors++
+			return err
 		}
 	}
 	if !s.ReadOnly {
 		for i = 0; i < s.Info.oltpIndexUpdates; i++ {
 			//db.sbtest8.update({_id: 5523412}, {$inc: {k: 1}}, false, false)
-			randID := s.RandSource.Int63n(s.MaxID)
-			err := coll.Update(bson.M{"_id": randID}, bson.M{"$inc": bson.M{"k": 1}})
+			randID := s.Keys.Next(s.MaxID)
+			err := txn.Update(coll, bson.M{"_id": randID}, bson.M{"$inc": bson.M{"k": 1}})
 			if err != nil {
-				// we got an error
-				sbresult.NumErrors++
+				return err
 			}
 		}
 		for i = 0; i < s.Info.oltpNonIndexUpdates; i++ {
 			//db.sbtest8.update({_id: 5523412}, {$set: {c: "hello there"}}, false, false)
-			randID := s.RandSource.Int63n(s.MaxID)
-			err := coll.Update(bson.M{"_id": randID}, bson.M{"$set": bson.M{"c": sysbench.CString(s.RandSource)}})
+			randID := s.Keys.Next(s.MaxID)
+			err := txn.Update(coll, bson.M{"_id": randID}, bson.M{"$set": bson.M{"c": sysbench.CString(s.RandSource)}})
 			if err != nil {
-				// we got an error
-				sbresult.NumErrors++
+				return err
 			}
 		}
 	}
 	// remove an ID
 	// re-insert the ID
-	randID := s.RandSource.Int63n(s.MaxID)
-	err := coll.Remove(bson.M{"_id": randID})
+	randID := s.Keys.Next(s.MaxID)
+	err := txn.Remove(coll, bson.M{"_id": randID})
 	if err != nil {
-		// we got an error
-		sbresult.NumErrors++
+		return err
 	}
 	// TODO: re-insert the ID
-	err = coll.Insert(sysbench.Doc{
+	err = txn.Insert(coll, sysbench.Doc{
 		uint64(randID),
 		s.RandSource.Int(),
 		s.RandSource.Int(),
 		sysbench.CString(s.RandSource),
 		sysbench.PadString(s.RandSource)})
-	if err != nil {
-		// we got an error
-		sbresult.NumErrors++
-	} else {
-		txn.Commit()
-	}
-
-	// send result over channel
-	sbresult.NumTransactions++
-	c <- sbresult
+	return err
 }
 
+// closes the session the transactions ran on
 func (s SysbenchTransaction) Close() {
+	s.Session.Close()
 }
 
 // implements ResultManager
 type SysbenchResult struct {
 	NumTransactions uint64 `type:"counter" report:"iter,cum,total"`
 	NumErrors       uint64 `type:"counter" report:"total"`
+	NumRetries      uint64 `type:"counter" report:"total"`
+	NumCommits      uint64 `type:"counter" report:"iter,cum,total"`
+	NumAborts       uint64 `type:"counter" report:"total"`
 }
 
 var (
@@ -184,24 +197,143 @@ var (
 	oltpDistinctRanges  = flag.Uint("oltpDistinctRanges", 1, "number of aggregation queries using disting per transaction ")
 	oltpIndexUpdates    = flag.Uint("oltpIndexUpdates", 1, "number of updates on an indexed field per transaction")
 	oltpNonIndexUpdates = flag.Uint("oltpNonIndexUpdates", 1, "number of updates on a non-indexed field per transaction")
+
+	// for finding the capacity of the server at a latency target
+	sweep             = flag.Bool("sweep", false, "if true, run successive phases of increasing load until the p99 latency of a transaction exceeds -sweepTargetP99, instead of a single run")
+	sweepMode         = flag.String("sweepMode", "threads", "what the sweep increases: \"threads\" (the number of threads) or \"rate\" (the max transactions per second, with -numThreads threads)")
+	sweepStart        = flag.Uint64("sweepStart", 8, "number of threads, or transactions per second, of the first phase of the sweep")
+	sweepStep         = flag.Uint64("sweepStep", 8, "amount the number of threads, or transactions per second, is increased by for each phase of the sweep")
+	sweepMax          = flag.Uint64("sweepMax", 512, "number of threads, or transactions per second, of the last phase of the sweep")
+	sweepPhaseSeconds = flag.Uint64("sweepPhaseSeconds", 60, "number of seconds each phase of the sweep runs")
+	sweepTargetP99    = flag.Duration("sweepTargetP99", 100*time.Millisecond, "p99 transaction latency at which the sweep stops")
+	sweepOutput       = flag.String("sweepOutput", "", "if set, file to write the throughput-vs-latency curve of the sweep to, as CSV")
 )
 
+// returns the max transactions per second of each of numThreads threads, which together
+// run at most maxTPS (0 means unlimited). The first threads run the remainder of the split.
+// Returns an error if a thread would get a rate of 0, which means unlimited
+func splitTPS(maxTPS uint64, numThreads uint) ([]uint64, error) {
+	if maxTPS > 0 && maxTPS < uint64(numThreads) {
+		return nil, fmt.Errorf("cannot run %d transactions per second on %d threads, each thread must run at least one", maxTPS, numThreads)
+	}
+	ret := make([]uint64, numThreads)
+	for i := range ret {
+		ret[i] = maxTPS / uint64(numThreads)
+		if uint64(i) < maxTPS%uint64(numThreads) {
+			ret[i]++
+		}
+	}
+	return ret, nil
+}
+
+// returns the works for numThreads threads running sysbench transactions,
+// together running at most maxTPS transactions per second (0 means unlimited).
+// maxTPS is split evenly across the threads, so it must be at least numThreads
+func makeWorkers(session *mgo.Session, info SysbenchInfo, numThreads uint, maxTPS uint64) []benchmark.WorkInfo {
+	tps, err := splitTPS(maxTPS, numThreads)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// passed to the transactions, so that they do not look it up
+	server, err := mongotools.GetServerInfo(session)
+	if err != nil {
+		log.Fatal("Received error ", err, " when getting the information of the server, exiting")
+	}
+	workers := make([]benchmark.WorkInfo, 0, numThreads)
+	var i uint
+	for i = 0; i < numThreads; i++ {
+		// closed by SysbenchTransaction.Close
+		copiedSession := session.Copy()
+		if !*readOnly {
+			// allows transactions to be run on this session. Read-only
+			// transactions may run on secondaries, as -readPreference defines
+			copiedSession.SetMode(mgo.Strong, true)
+		}
+		// RunInTransactionWithOptions refreshes the session after socket errors
+		retry := mongotools.DefaultRetryPolicy()
+		randSource := rand.New(rand.NewSource(time.Now().UnixNano()))
+		var currItem benchmark.Work = SysbenchTransaction{
+			info,
+			copiedSession,
+			*dbname,
+			*collname,
+			randSource,
+			*numCollections,
+			*readOnly,
+			*numMaxInserts,
+			retry,
+			server,
+			&mongotools.Transaction{DB: copiedSession.DB(*dbname)},
+			distributions.NewFromFlags(randSource, *numMaxInserts)}
+		var currInfo benchmark.WorkInfo = benchmark.WorkInfo{currItem, tps[i], 1, 0}
+		workers = append(workers, currInfo)
+	}
+	return workers
+}
+
+// runs a sweep as defined by the sweep flags, and writes the resulting curve
+// to -sweepOutput if it is set
+func runSweep(session *mgo.Session, info SysbenchInfo) {
+	if *sweepStart == 0 {
+		log.Fatal("sweepStart must be > 0")
+	}
+	var makeWorks func(level uint64) []benchmark.WorkInfo
+	switch *sweepMode {
+	case "threads":
+		// checked here rather than by makeWorkers, so that the sweep does not fail after its first phases
+		if *numMaxTPS > 0 && *sweepMax > *numMaxTPS {
+			log.Fatal("sweepMax must be <= numMaxTPS, so that each thread runs at least one transaction per second")
+		}
+		makeWorks = func(level uint64) []benchmark.WorkInfo {
+			return makeWorkers(session, info, uint(level), *numMaxTPS)
+		}
+	case "rate":
+		if *sweepStart < uint64(*numThreads) {
+			log.Fatal("sweepStart must be >= numThreads, so that each thread runs at least one transaction per second")
+		}
+		makeWorks = func(level uint64) []benchmark.WorkInfo {
+			return makeWorkers(session, info, *numThreads, level)
+		}
+	default:
+		log.Fatal("invalid value for sweepMode: ", *sweepMode)
+	}
+	opts := benchmark.SweepOptions{
+		Start:         *sweepStart,
+		Step:          *sweepStep,
+		Max:           *sweepMax,
+		PhaseDuration: time.Duration(*sweepPhaseSeconds) * time.Second,
+		TargetP99:     *sweepTargetP99}
+	points, best := benchmark.Sweep(new(SysbenchResult), makeWorks, opts)
+	if *sweepOutput != "" {
+		f, err := os.Create(*sweepOutput)
+		if err != nil {
+			log.Fatal("Error creating ", *sweepOutput, ": ", err)
+		}
+		defer f.Close()
+		if err = benchmark.WriteSweepCSV(f, points, best); err != nil {
+			log.Fatal("Error writing ", *sweepOutput, ": ", err)
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 
-	numTPSPerThread := (*numMaxTPS) / (uint64(*numThreads))
+	// connects as given on the command line, with the write concern,
+	// read preference and timeouts given there
+	session := mongotools.Dial(*host)
+	defer session.Close()
+	// samples the status of the server during the run, see -serverStatusInterval
+	mongotools.MonitorServerStatus(session)
 
-	session, err := mgo.Dial(*host)
-	if err != nil {
-		log.Fatal("Error connecting to ", *host, ": ", err)
+	if !*readOnly && !mongotools.ReadsFromPrimary() {
+		log.Println("transactions that write run on the primary, -readPreference only applies with -readOnly")
 	}
-	// so we are not in fire and forget
-	session.SetSafe(&mgo.Safe{})
-	defer session.Close()
 
 	mongotools.VerifyNotCreating()
-	// just verifies that collections exist
-	mongotools.MakeCollections(*collname, *dbname, *numCollections, session, make([]mgo.Index, 0))
+	// verifies that collections exist, and with -verifyIndexes,
+	// that they have the index sysbenchload creates
+	mongotools.MakeCollections(*collname, *dbname, *numCollections, session, sysbench.Indexes())
 
 	info := SysbenchInfo{
 		*oltpRangeSize,
@@ -212,25 +344,11 @@ func main() {
 		*oltpDistinctRanges,
 		*oltpIndexUpdates,
 		*oltpNonIndexUpdates}
-	workers := make([]benchmark.WorkInfo, 0, *numThreads)
-	var i uint
-	for i = 0; i < *numThreads; i++ {
-		copiedSession := session.Copy()
-		defer copiedSession.Close()
-		// allows transactions to be run on this session
-		copiedSession.SetMode(mgo.Strong, true)
-		var currItem benchmark.Work = SysbenchTransaction{
-			info,
-			copiedSession,
-			*dbname,
-			*collname,
-			rand.New(rand.NewSource(time.Now().UnixNano())),
-			*numCollections,
-			*readOnly,
-			*numMaxInserts}
-		var currInfo benchmark.WorkInfo = benchmark.WorkInfo{currItem, numTPSPerThread, 1, 0}
-		workers = append(workers, currInfo)
+	if *sweep {
+		runSweep(session, info)
+		return
 	}
+	workers := makeWorkers(session, info, *numThreads, *numMaxTPS)
 	res := new(SysbenchResult)
 	fmt.Println("passing in ", *numSeconds)
 	benchmark.Run(res, workers, time.Duration(*numSeconds)*time.Second)
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitTPS(t *testing.T) {
+	tests := []struct {
+		maxTPS     uint64
+		numThreads uint
+		want       []uint64
+	}{
+		{0, 3, []uint64{0, 0, 0}},
+		{3, 3, []uint64{1, 1, 1}},
+		{10, 3, []uint64{4, 3, 3}},
+		{11, 3, []uint64{4, 4, 3}},
+		{12, 3, []uint64{4, 4, 4}},
+		{1000, 1, []uint64{1000}},
+		{9, 8, []uint64{2, 1, 1, 1, 1, 1, 1, 1}},
+	}
+	for _, test := range tests {
+		got, err := splitTPS(test.maxTPS, test.numThreads)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitTPS(%d, %d) = %v, %v, want %v", test.maxTPS, test.numThreads, got, err, test.want)
+		}
+	}
+	for _, numThreads := range []uint{2, 8, 64} {
+		if got, err := splitTPS(uint64(numThreads)-1, numThreads); err == nil {
+			t.Errorf("splitTPS(%d, %d) = %v, want an error", numThreads-1, numThreads, got)
+		}
+	}
+}
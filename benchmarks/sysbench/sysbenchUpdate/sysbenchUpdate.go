@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"github.com/Tokutek/go-benchmark"
+	"github.com/Tokutek/go-benchmark/benchmarks/sysbench"
+	"github.com/Tokutek/go-benchmark/distributions"
 	"github.com/Tokutek/go-benchmark/mongotools"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
@@ -27,6 +29,9 @@ type SysbenchUpdateInfo struct {
 	NumCollections  int
 	MaxID           int64
 	doFindAndModify bool // if true, use findAndModify, else use updates
+	updatesPerCall  uint // the number of updates of each call to Do
+	// chooses the ids updated, from RandSource
+	Keys distributions.Distribution
 }
 
 func runQuery(filter bson.M, projection bson.M, coll *mgo.Collection) {
@@ -36,28 +41,26 @@ func runQuery(filter bson.M, projection bson.M, coll *mgo.Collection) {
 	}
 }
 
-func (s SysbenchUpdateInfo) Do(c chan<- interface{}) {
+func (s SysbenchUpdateInfo) Do(r *benchmark.Recorder) {
 	db := s.Session.DB(s.Dbname)
 	collectionIndex := s.RandSource.Int31n(int32(s.NumCollections))
 	coll := db.C(mongotools.GetCollectionString(s.Collname, int(collectionIndex)))
 	var sbresult SysbenchUpdateResult
 
-	var i uint
-
 	//db.sbtest8.update({_id: 5523412}, {$set: {c: "hello there"}}, false, false)
-	// have each thread do 50 updates before sending results
-	for i = 0; i < 50; i++ {
-		randID := s.RandSource.Int63n(s.MaxID)
+	// one update per call unless -updatesPerCall says otherwise, so that the
+	// latencies recorded, and -numMaxTPS, are per update
+	var i uint
+	for i = 0; i < s.updatesPerCall; i++ {
+		randID := s.Keys.Next(s.MaxID)
 		var err error
 		if s.doFindAndModify {
 			change := mgo.Change{
 				Update:    bson.M{"$inc": bson.M{"d": 1}},
 				ReturnNew: true,
 			}
-			var info *mgo.ChangeInfo
 			var doc bson.M
-			info, err = coll.Find(bson.M{"_id": randID}).Apply(change, &doc)
-			info = info // to make the compiler shut up about unused variable info.
+			_, err = coll.Find(bson.M{"_id": randID}).Apply(change, &doc)
 		} else {
 			err = coll.Update(bson.M{"_id": randID}, bson.M{"$inc": bson.M{"d": 1}})
 		}
@@ -65,11 +68,9 @@ func (s SysbenchUpdateInfo) Do(c chan<- interface{}) {
 			// we got an error
 			sbresult.NumErrors++
 		}
-
-		// send result over channel
 		sbresult.NumUpdates++
 	}
-	c <- sbresult
+	r.Add(sbresult)
 }
 
 func (s SysbenchUpdateInfo) Close() {
@@ -92,27 +93,31 @@ var (
 	numThreads    = flag.Uint("numThreads", 64, "specify the number of threads")
 	numMaxInserts = flag.Int64("numMaxInserts", 10000000, "number of documents in each collection")
 	numSeconds    = flag.Uint64("numSeconds", 600, "number of seconds the benchmark is to run.")
-	numMaxTPS     = flag.Uint64("numMaxTPS", 0, "number of maximum transactions to process. If 0, then unlimited")
+	numMaxTPS     = flag.Uint64("numMaxTPS", 0, "number of maximum updates to process per second (calls, with -updatesPerCall). If 0, then unlimited")
 
 	doFindAndModify = flag.Bool("findAndModify", false, "whether to use findAndModify instead of update")
+	updatesPerCall  = flag.Uint("updatesPerCall", 1, "number of updates each thread does per call, which are recorded as one operation, with one latency")
 )
 
 func main() {
 	flag.Parse()
+	if *updatesPerCall == 0 {
+		log.Fatal("updatesPerCall must be > 0")
+	}
 
 	numTPSPerThread := (*numMaxTPS) / (uint64(*numThreads))
 
-	session, err := mgo.Dial(*host)
-	if err != nil {
-		log.Fatal("Error connecting to ", *host, ": ", err)
-	}
-	// so we are not in fire and forget
-	session.SetSafe(&mgo.Safe{})
+	// connects as given on the command line, with the write concern,
+	// read preference and timeouts given there
+	session := mongotools.Dial(*host)
 	defer session.Close()
+	// samples the status of the server during the run, see -serverStatusInterval
+	mongotools.MonitorServerStatus(session)
 
 	mongotools.VerifyNotCreating()
-	// just verifies that collections exist
-	mongotools.MakeCollections(*collname, *dbname, *numCollections, session, make([]mgo.Index, 0))
+	// verifies that collections exist, and with -verifyIndexes,
+	// that they have the index sysbenchload creates
+	mongotools.MakeCollections(*collname, *dbname, *numCollections, session, sysbench.Indexes())
 
 	workers := make([]benchmark.WorkInfo, 0, *numThreads)
 	var i uint
@@ -121,14 +126,17 @@ func main() {
 		defer copiedSession.Close()
 		// allows transactions to be run on this session
 		copiedSession.SetMode(mgo.Strong, true)
+		randSource := rand.New(rand.NewSource(time.Now().UnixNano()))
 		var currItem benchmark.Work = SysbenchUpdateInfo{
 			copiedSession,
 			*dbname,
 			*collname,
-			rand.New(rand.NewSource(time.Now().UnixNano())),
+			randSource,
 			*numCollections,
 			*numMaxInserts,
-			*doFindAndModify}
+			*doFindAndModify,
+			*updatesPerCall,
+			distributions.NewFromFlags(randSource, *numMaxInserts)}
 		var currInfo benchmark.WorkInfo = benchmark.WorkInfo{currItem, numTPSPerThread, 1, 0}
 		workers = append(workers, currInfo)
 	}
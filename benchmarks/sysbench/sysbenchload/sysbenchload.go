@@ -6,28 +6,12 @@ import (
 	"github.com/Tokutek/go-benchmark/benchmarks/iibench"
 	"github.com/Tokutek/go-benchmark/benchmarks/sysbench"
 	"github.com/Tokutek/go-benchmark/mongotools"
-	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
 	"log"
 	"math/rand"
 	"time"
 )
 
-type SysbenchDocGenerator struct {
-	RandSource *rand.Rand
-	currID     uint64
-}
-
-func (generator *SysbenchDocGenerator) Generate() interface{} {
-	ret := sysbench.Doc{
-		generator.currID,
-		generator.RandSource.Int(),
-		generator.RandSource.Int(),
-		sysbench.CString(generator.RandSource),
-		sysbench.PadString(generator.RandSource)}
-	generator.currID++
-	return ret
-}
-
 // implements Work
 type SysbenchWriter struct {
 	writers []benchmark.WorkInfo
@@ -39,9 +23,9 @@ func (w SysbenchWriter) Close() {
 	}
 }
 
-func (w SysbenchWriter) Do(c chan<- interface{}) {
+func (w SysbenchWriter) Do(r *benchmark.Recorder) {
 	for x := range w.writers {
-		w.writers[x].Work.Do(c)
+		w.writers[x].Work.Do(r)
 	}
 }
 
@@ -55,6 +39,14 @@ var (
 	// for benchmark
 	numWriters              = flag.Int("numWriters", 8, "specify the number of writer threads")
 	numInsertsPerCollection = flag.Int("numInsertsPerCollection", 10000000, "number of inserts to be done per collection")
+	datasetFile             = flag.String("datasetFile", "", "if set, dataset file (see gendata) whose documents are loaded into each collection, instead of generating them")
+	datasetFormat           = flag.String("datasetFormat", "", "format of -datasetFile: \"bson\" or \"json\". Defaults to the one of its extension, as gendata's -format")
+	datasetReplay           = flag.Bool("datasetReplay", false, "if true, a collection that got all documents of -datasetFile gets them again from the first, which only works for documents without _id. Otherwise running out of documents is fatal")
+
+	// for mixing other operations into the batches of inserts, not with -datasetFile
+	updateFraction = flag.Float64("updateFraction", 0, "fraction of the operations of each batch that update a random document loaded so far, instead of inserting one")
+	upsertFraction = flag.Float64("upsertFraction", 0, "fraction of the operations of each batch that upsert a random document loaded so far")
+	deleteFraction = flag.Float64("deleteFraction", 0, "fraction of the operations of each batch that delete a random document loaded so far")
 )
 
 func main() {
@@ -62,19 +54,29 @@ func main() {
 	if *numWriters > *numCollections {
 		log.Fatal("numWriters should not be greater than numCollections")
 	}
-
-	session, err := mgo.Dial(*host)
-	if err != nil {
-		log.Fatal("Error connecting to ", *host, ": ", err)
+	if *updateFraction < 0 || *upsertFraction < 0 || *deleteFraction < 0 || *updateFraction+*upsertFraction+*deleteFraction > 1 {
+		log.Fatal("updateFraction, upsertFraction and deleteFraction must be positive, and add up to at most 1")
+	}
+	if *datasetFile != "" && *updateFraction+*upsertFraction+*deleteFraction > 0 {
+		log.Fatal("updateFraction, upsertFraction and deleteFraction cannot be used with datasetFile, whose documents are only inserted")
 	}
-	// so we are not in fire and forget
-	session.SetSafe(&mgo.Safe{})
-	defer session.Close()
 
-	indexes := make([]mgo.Index, 1)
-	indexes[0] = mgo.Index{Key: []string{"k"}}
+	// connects as given on the command line, with the write concern,
+	// read preference and timeouts given there
+	session := mongotools.Dial(*host)
+	defer session.Close()
+	// samples the status of the server during the run, see -serverStatusInterval
+	mongotools.MonitorServerStatus(session)
 
-	mongotools.MakeCollections(*collname, *dbname, *numCollections, session, indexes)
+	options := mongotools.CollectionOptions{Indexes: mongotools.IndexSpecs(sysbench.Indexes()...)}
+	// with -shardKey _id and -numInitialChunks, the collections are split evenly on the ids loaded
+	options.Sharding.SplitPoints = func(key bson.D, numChunks int) []bson.D {
+		if len(key) != 1 || key[0].Name != "_id" {
+			return nil
+		}
+		return mongotools.EvenSplitPoints("_id", 0, int64(*numInsertsPerCollection), numChunks)
+	}
+	mongotools.MakeCollectionsWithOptions(*collname, *dbname, *numCollections, session, options)
 	// at this point we have created the collection, now run the benchmark
 	res := new(iibench.Result)
 	workers := make([]benchmark.WorkInfo, 0, *numWriters)
@@ -84,9 +86,19 @@ func main() {
 		copiedSession := session.Copy()
 		defer copiedSession.Close()
 		currCollectionString := mongotools.GetCollectionString(*collname, i)
-		var gen *SysbenchDocGenerator = new(SysbenchDocGenerator)
-		gen.RandSource = rand.New(rand.NewSource(time.Now().UnixNano()))
-		var curr benchmark.WorkInfo = mongotools.NewInsertWork(gen, copiedSession.DB(*dbname).C(currCollectionString), *numInsertsPerCollection)
+		var gen mongotools.DocGenerator
+		if *datasetFile != "" {
+			fileGen := mongotools.NewFileDocGenerator(*datasetFile, *datasetFormat, *datasetReplay)
+			defer fileGen.Close()
+			gen = fileGen
+		} else {
+			sbGen := sysbench.NewDocGenerator(rand.New(rand.NewSource(time.Now().UnixNano())))
+			sbGen.UpdateFraction = *updateFraction
+			sbGen.UpsertFraction = *upsertFraction
+			sbGen.DeleteFraction = *deleteFraction
+			gen = sbGen
+		}
+		var curr benchmark.WorkInfo = mongotools.NewInsertWork(gen, copiedSession.DB(*dbname).C(currCollectionString), mongotools.InsertOptionsFromFlags(*numInsertsPerCollection))
 		writers[i%*numWriters].writers = append(writers[i%*numWriters].writers, curr)
 	}
 	for i := 0; i < *numWriters; i++ {
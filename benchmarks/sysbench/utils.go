@@ -2,6 +2,7 @@ package sysbench
 
 import (
 	"bytes"
+	"labix.org/v2/mgo"
 	"math/rand"
 )
 
@@ -13,6 +14,11 @@ type Doc struct {
 	Pad string "pad"
 }
 
+// returns the secondary indexes of a sysbench collection
+func Indexes() []mgo.Index {
+	return []mgo.Index{mgo.Index{Key: []string{"k"}}}
+}
+
 var ctemplate string = "###########-###########-###########-###########-###########-###########-###########-###########-###########-###########"
 var padtemplate string = "###########-###########-###########-###########-###########"
 
@@ -0,0 +1,226 @@
+package distributions
+
+import (
+	"flag"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+)
+
+var (
+	keyDistribution    = flag.String("keyDistribution", "uniform", "how the keys read and updated are chosen: \"uniform\", \"zipfian\", \"scrambledZipfian\" (zipfian, with the popular keys spread over the key space), \"latest\" (zipfian, favoring the highest keys, the most recently inserted), \"hotspot\", \"pareto\" or \"special\" (as sysbench's)")
+	zipfianConstant    = flag.Float64("zipfianConstant", 0.99, "skew of the zipfian distributions, between 0 and 1 (exclusive). Higher is more skewed")
+	hotspotFraction    = flag.Float64("hotspotFraction", 0.2, "fraction of the keys that are hot, for the hotspot distribution")
+	hotspotOpnFraction = flag.Float64("hotspotOpnFraction", 0.8, "fraction of the operations that go to the hot keys, for the hotspot distribution")
+	paretoShape        = flag.Float64("paretoShape", 1.16, "shape of the pareto distribution, greater than 0. Higher makes the lowest keys more popular")
+	specialPct         = flag.Float64("specialPct", 1, "percentage of the keys that are special, for the special distribution (sysbench's --oltp-dist-pct)")
+	specialResPct      = flag.Float64("specialResPct", 75, "percentage of the operations that go to the special keys, for the special distribution (sysbench's --oltp-dist-res)")
+)
+
+// A Distribution chooses keys, which are integers between 0 and some n (exclusive),
+// so that some keys may be chosen more often than others. Distributions draw their
+// random numbers from the source they are created with, so like it, are not
+// safe to use from several goroutines.
+type Distribution interface {
+	// returns a key in [0, n). n may differ between calls, though the zipfian
+	// distributions are faster if it is always the n they were created with
+	Next(n int64) int64
+}
+
+// returns the Distribution the flags define, for keys in [0, n), which draws its random numbers from randSource
+func NewFromFlags(randSource *rand.Rand, n int64) Distribution {
+	return New(*keyDistribution, randSource, n)
+}
+
+// returns the Distribution named name, as -keyDistribution takes, which draws
+// its random numbers from randSource. The other flags define its parameters.
+// n is the number of keys Next will be called with, so that what the zipfian
+// distributions compute for it is computed here, before the benchmark runs, 0 if unknown
+func New(name string, randSource *rand.Rand, n int64) Distribution {
+	switch name {
+	case "uniform":
+		return Uniform{randSource}
+	case "zipfian":
+		return NewZipfian(randSource, *zipfianConstant, n)
+	case "scrambledZipfian":
+		return &ScrambledZipfian{NewZipfian(randSource, *zipfianConstant, n)}
+	case "latest":
+		return &Latest{NewZipfian(randSource, *zipfianConstant, n)}
+	case "hotspot":
+		return NewHotspot(randSource, *hotspotFraction, *hotspotOpnFraction)
+	case "pareto":
+		return NewPareto(randSource, *paretoShape)
+	case "special":
+		// sysbench's special distribution is a hotspot on the lowest keys
+		return NewHotspot(randSource, *specialPct/100, *specialResPct/100)
+	}
+	log.Fatal("invalid value for keyDistribution: ", name)
+	return nil
+}
+
+// A Distribution choosing all keys equally often
+type Uniform struct {
+	randSource *rand.Rand
+}
+
+func (u Uniform) Next(n int64) int64 {
+	return u.randSource.Int63n(n)
+}
+
+// returns the sum of 1/i^theta for i from 1 to n
+func zeta(n int64, theta float64) float64 {
+	return zetaFrom(0, 0, n, theta)
+}
+
+// returns zeta(n, theta) given sum, zeta(start, theta), with start <= n,
+// taking time proportional to n-start
+func zetaFrom(start int64, sum float64, n int64, theta float64) float64 {
+	for i := start + 1; i <= n; i++ {
+		sum += 1 / math.Pow(float64(i), theta)
+	}
+	return sum
+}
+
+// A Distribution in which the probability of key i is proportional to 1/(i+1)^theta,
+// so that key 0 is the most popular, as in YCSB. It is computed as described in
+// "Quickly Generating Billion-Record Synthetic Databases" by Gray et al.
+type Zipfian struct {
+	randSource *rand.Rand
+	theta      float64
+	alpha      float64
+	zeta2      float64
+	// the constants for the last n
+	n     int64
+	zetan float64
+	eta   float64
+}
+
+// returns a Zipfian distribution of skew theta, which must be between 0 and 1 (exclusive),
+// with its constants computed for n keys, unless n is 0
+func NewZipfian(randSource *rand.Rand, theta float64, n int64) *Zipfian {
+	if theta <= 0 || theta >= 1 {
+		log.Fatal("invalid zipfian constant ", theta, ", must be between 0 and 1")
+	}
+	z := &Zipfian{randSource: randSource, theta: theta, alpha: 1 / (1 - theta), zeta2: zeta(2, theta)}
+	if n > 0 {
+		z.setN(n)
+	}
+	return z
+}
+
+// computes the constants for n keys. When n grows, as the number of documents does,
+// this takes time proportional to the new keys, otherwise to n
+func (z *Zipfian) setN(n int64) {
+	if n > z.n {
+		z.zetan = zetaFrom(z.n, z.zetan, n, z.theta)
+	} else {
+		z.zetan = zeta(n, z.theta)
+	}
+	z.n = n
+	z.eta = (1 - math.Pow(2/float64(n), 1-z.theta)) / (1 - z.zeta2/z.zetan)
+}
+
+func (z *Zipfian) Next(n int64) int64 {
+	if n != z.n {
+		z.setN(n)
+	}
+	u := z.randSource.Float64()
+	uz := u * z.zetan
+	if uz < 1 {
+		return 0
+	}
+	if uz < z.zeta2 && n > 1 {
+		return 1
+	}
+	ret := int64(float64(n) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	if ret >= n {
+		ret = n - 1
+	}
+	return ret
+}
+
+// A zipfian Distribution whose popular keys are spread over all keys by hashing,
+// instead of being the lowest ones, as in YCSB
+type ScrambledZipfian struct {
+	zipfian *Zipfian
+}
+
+func (s *ScrambledZipfian) Next(n int64) int64 {
+	h := fnv.New64a()
+	k := uint64(s.zipfian.Next(n))
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = byte(k >> uint(8*i))
+	}
+	h.Write(buf[:])
+	return int64(h.Sum64() % uint64(n))
+}
+
+// A zipfian Distribution in which the highest keys are the most popular,
+// so that keys inserted in increasing order are read most while they are recent
+type Latest struct {
+	zipfian *Zipfian
+}
+
+func (l *Latest) Next(n int64) int64 {
+	return n - 1 - l.zipfian.Next(n)
+}
+
+// A Distribution in which a fraction of operations, opnFraction, go to a fraction
+// of the keys, hotFraction, the lowest ones. Keys are chosen uniformly within
+// the hot keys, and within the others.
+type Hotspot struct {
+	randSource  *rand.Rand
+	hotFraction float64
+	opnFraction float64
+}
+
+// returns a Hotspot distribution, whose fractions must be between 0 and 1
+func NewHotspot(randSource *rand.Rand, hotFraction float64, opnFraction float64) *Hotspot {
+	if hotFraction < 0 || hotFraction > 1 || opnFraction < 0 || opnFraction > 1 {
+		log.Fatal("invalid hotspot fractions ", hotFraction, " and ", opnFraction, ", must be between 0 and 1")
+	}
+	return &Hotspot{randSource, hotFraction, opnFraction}
+}
+
+func (h *Hotspot) Next(n int64) int64 {
+	numHot := int64(float64(n) * h.hotFraction)
+	if numHot == 0 {
+		numHot = 1
+	}
+	if numHot >= n || h.randSource.Float64() < h.opnFraction {
+		return h.randSource.Int63n(numHot)
+	}
+	return numHot + h.randSource.Int63n(n-numHot)
+}
+
+// A Distribution in which keys follow a Pareto distribution bounded to [1, n+1],
+// minus one, so that the lowest keys are the most popular
+type Pareto struct {
+	randSource *rand.Rand
+	shape      float64
+}
+
+// returns a Pareto distribution, whose shape must be greater than 0
+func NewPareto(randSource *rand.Rand, shape float64) *Pareto {
+	if shape <= 0 {
+		log.Fatal("invalid pareto shape ", shape, ", must be greater than 0")
+	}
+	return &Pareto{randSource, shape}
+}
+
+func (p *Pareto) Next(n int64) int64 {
+	// inverts the distribution function of the bounded Pareto distribution, of minimum 1
+	u := p.randSource.Float64()
+	ha := math.Pow(float64(n+1), p.shape)
+	x := math.Pow((ha-u*ha+u)/ha, -1/p.shape)
+	ret := int64(x) - 1
+	if ret >= n {
+		ret = n - 1
+	}
+	if ret < 0 {
+		ret = 0
+	}
+	return ret
+}
@@ -0,0 +1,104 @@
+package distributions
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const numSamples = 200000
+
+// returns the fraction of numSamples keys of d, for n keys, that are less than k
+func fractionBelow(d Distribution, n int64, k int64) float64 {
+	below := 0
+	for i := 0; i < numSamples; i++ {
+		if d.Next(n) < k {
+			below++
+		}
+	}
+	return float64(below) / numSamples
+}
+
+func checkFraction(t *testing.T, what string, got float64, want float64) {
+	if math.Abs(got-want) > 0.01 {
+		t.Errorf("%s: got %.4f, want %.4f", what, got, want)
+	}
+}
+
+func TestRange(t *testing.T) {
+	for _, name := range []string{"uniform", "zipfian", "scrambledZipfian", "latest", "hotspot", "pareto", "special"} {
+		for _, n := range []int64{1, 2, 3, 10, 1000} {
+			// created for another n, so that Next must handle n differing
+			d := New(name, rand.New(rand.NewSource(1)), 100)
+			for i := 0; i < 10000; i++ {
+				if k := d.Next(n); k < 0 || k >= n {
+					t.Fatalf("%s: key %d out of [0, %d)", name, k, n)
+				}
+			}
+		}
+	}
+}
+
+func TestZipfianConstants(t *testing.T) {
+	const n = 1000
+	const theta = 0.99
+	z := NewZipfian(rand.New(rand.NewSource(1)), theta, n)
+	if z.n != n {
+		t.Fatalf("constants computed for %d keys, want %d", z.n, n)
+	}
+	var zetan float64
+	for i := 1; i <= n; i++ {
+		zetan += 1 / math.Pow(float64(i), theta)
+	}
+	zeta2 := 1 + 1/math.Pow(2, theta)
+	eta := (1 - math.Pow(2.0/n, 1-theta)) / (1 - zeta2/zetan)
+	if math.Abs(z.zetan-zetan) > 1e-9 || math.Abs(z.eta-eta) > 1e-9 {
+		t.Errorf("got zetan %g and eta %g, want %g and %g", z.zetan, z.eta, zetan, eta)
+	}
+	// key i is chosen with probability 1/((i+1)^theta * zetan)
+	checkFraction(t, "zipfian key 0", fractionBelow(z, n, 1), 1/zetan)
+	checkFraction(t, "zipfian keys 0 and 1", fractionBelow(z, n, 2), zeta2/zetan)
+}
+
+func TestZipfianGrowing(t *testing.T) {
+	const theta = 0.99
+	z := NewZipfian(rand.New(rand.NewSource(1)), theta, 10)
+	// growing continues the sum of the previous n, shrinking starts over
+	for _, n := range []int64{11, 1000, 100000, 50, 2000} {
+		z.Next(n)
+		want := NewZipfian(rand.New(rand.NewSource(1)), theta, n)
+		if z.n != n || math.Abs(z.zetan-want.zetan) > 1e-9 || math.Abs(z.eta-want.eta) > 1e-9 {
+			t.Errorf("%d keys: got n %d, zetan %g and eta %g, want zetan %g and eta %g", n, z.n, z.zetan, z.eta, want.zetan, want.eta)
+		}
+	}
+}
+
+func TestLatest(t *testing.T) {
+	const n = 1000
+	d := New("latest", rand.New(rand.NewSource(1)), n)
+	checkFraction(t, "latest keys below the last", fractionBelow(d, n, n-1), 1-1/zeta(n, *zipfianConstant))
+}
+
+func TestHotspot(t *testing.T) {
+	const n = 1000
+	h := NewHotspot(rand.New(rand.NewSource(1)), 0.2, 0.8)
+	checkFraction(t, "hot keys", fractionBelow(h, n, 200), 0.8)
+	// the other keys are chosen uniformly
+	checkFraction(t, "cold keys below 600", fractionBelow(h, n, 600)-fractionBelow(h, n, 200), 0.1)
+	// with no hot keys, the lowest key is hot, and with all keys hot, all are uniform
+	checkFraction(t, "one hot key", fractionBelow(NewHotspot(rand.New(rand.NewSource(1)), 0, 0.5), n, 1), 0.5)
+	checkFraction(t, "all hot", fractionBelow(NewHotspot(rand.New(rand.NewSource(1)), 1, 0.5), n, 500), 0.5)
+}
+
+func TestPareto(t *testing.T) {
+	const n = 1000
+	const shape = 1.16
+	p := NewPareto(rand.New(rand.NewSource(1)), shape)
+	// the keys below k are the values of the bounded Pareto distribution
+	// on [1, n+1] below k+1, minus one
+	for _, k := range []int64{1, 10, 100, 500} {
+		want := (1 - math.Pow(float64(k+1), -shape)) / (1 - math.Pow(n+1, -shape))
+		checkFraction(t, fmt.Sprint("pareto keys below ", k), fractionBelow(p, n, k), want)
+	}
+}
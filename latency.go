@@ -0,0 +1,143 @@
+package benchmark
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// latencies are recorded in microseconds. Values below subBuckets get
+// a bucket each, larger values are split into powers of two, each of
+// which is split into subBuckets linear buckets. This bounds the relative
+// error of a percentile to 1/subBuckets (about 6%).
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+	maxExponent   = 40 // 2^40 microseconds is about 12 days
+	numBuckets    = subBuckets + (maxExponent-subBucketBits+1)*subBuckets
+)
+
+// A LatencyHistogram records the latencies of operations in a fixed
+// number of logarithmic buckets, so that percentiles can be computed
+// without keeping every sample. Record may be called concurrently with
+// Merge and the accessors.
+type LatencyHistogram struct {
+	counts [numBuckets]uint64
+	count  uint64
+	sum    uint64 // in microseconds
+	max    uint64 // in microseconds
+}
+
+// returns the bucket that v, in microseconds, falls in
+func bucketIndex(v uint64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	exp := 0
+	for x := v; x > 1; x >>= 1 {
+		exp++
+	}
+	if exp > maxExponent {
+		return numBuckets - 1
+	}
+	sub := (v >> uint(exp-subBucketBits)) & (subBuckets - 1)
+	return subBuckets + (exp-subBucketBits)*subBuckets + int(sub)
+}
+
+// returns the range of values, in microseconds, that fall in bucket i
+func bucketRange(i int) (low, high uint64) {
+	if i < subBuckets {
+		return uint64(i), uint64(i) + 1
+	}
+	exp := uint((i-subBuckets)/subBuckets + subBucketBits)
+	sub := uint64((i - subBuckets) % subBuckets)
+	shift := exp - subBucketBits
+	return (subBuckets + sub) << shift, (subBuckets + sub + 1) << shift
+}
+
+// Record adds the latency of one operation to the histogram
+func (h *LatencyHistogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	v := uint64(d / time.Microsecond)
+	atomic.AddUint64(&h.counts[bucketIndex(v)], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, v)
+	for {
+		curr := atomic.LoadUint64(&h.max)
+		if v <= curr || atomic.CompareAndSwapUint64(&h.max, curr, v) {
+			return
+		}
+	}
+}
+
+// Merge adds all the latencies recorded in other to h
+func (h *LatencyHistogram) Merge(other *LatencyHistogram) {
+	for i := range other.counts {
+		if n := atomic.LoadUint64(&other.counts[i]); n > 0 {
+			atomic.AddUint64(&h.counts[i], n)
+		}
+	}
+	atomic.AddUint64(&h.count, atomic.LoadUint64(&other.count))
+	atomic.AddUint64(&h.sum, atomic.LoadUint64(&other.sum))
+	otherMax := atomic.LoadUint64(&other.max)
+	for {
+		curr := atomic.LoadUint64(&h.max)
+		if otherMax <= curr || atomic.CompareAndSwapUint64(&h.max, curr, otherMax) {
+			return
+		}
+	}
+}
+
+// Count returns the number of latencies recorded
+func (h *LatencyHistogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Mean returns the average of the latencies recorded
+func (h *LatencyHistogram) Mean() time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadUint64(&h.sum)/n) * time.Microsecond
+}
+
+// Max returns the largest latency recorded
+func (h *LatencyHistogram) Max() time.Duration {
+	return time.Duration(atomic.LoadUint64(&h.max)) * time.Microsecond
+}
+
+// Percentile returns an estimate of the latency below which p percent
+// of the recorded latencies fall. For example, Percentile(99) is the p99 latency.
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	// the rank, indexed from 1, of the latency we are looking for
+	rank := uint64(p/100*float64(n) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i := range h.counts {
+		seen += atomic.LoadUint64(&h.counts[i])
+		if seen >= rank {
+			low, high := bucketRange(i)
+			v := (low + high) / 2
+			if max := atomic.LoadUint64(&h.max); v > max {
+				v = max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return h.Max()
+}
+
+// String summarizes the histogram with its count, mean and common percentiles
+func (h *LatencyHistogram) String() string {
+	return fmt.Sprintf("ops %d, mean %v, p50 %v, p95 %v, p99 %v, max %v",
+		h.Count(), h.Mean(), h.Percentile(50), h.Percentile(95), h.Percentile(99), h.Max())
+}
@@ -0,0 +1,88 @@
+package benchmark
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBuckets(t *testing.T) {
+	// the edges of the exact buckets and of the first powers of two
+	values := []uint64{0, 1, subBuckets - 1, subBuckets, subBuckets + 1, 2*subBuckets - 1, 2 * subBuckets, 2*subBuckets + 1,
+		4*subBuckets - 1, 4 * subBuckets, 1000, 1023, 1024, 1025, 1 << 30, 1<<maxExponent - 1, 1 << maxExponent}
+	for _, v := range values {
+		i := bucketIndex(v)
+		low, high := bucketRange(i)
+		if v < low || v >= high {
+			t.Errorf("%d falls in bucket %d, of [%d, %d)", v, i, low, high)
+		}
+		if i > 0 {
+			if _, prevHigh := bucketRange(i - 1); prevHigh != low {
+				t.Errorf("bucket %d starts at %d, but bucket %d ends at %d", i, low, i-1, prevHigh)
+			}
+		}
+	}
+	if i := bucketIndex(1 << 50); i != numBuckets-1 {
+		t.Errorf("values above 2^maxExponent fall in bucket %d, want the last, %d", i, numBuckets-1)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	h := new(LatencyHistogram)
+	if got := h.Percentile(99); got != 0 {
+		t.Errorf("p99 of no latencies = %v, want 0", got)
+	}
+	// the exact buckets give exact percentiles
+	for v := 1; v <= 10; v++ {
+		h.Record(time.Duration(v) * time.Microsecond)
+	}
+	for _, test := range []struct {
+		p    float64
+		want time.Duration
+	}{{0, 1}, {10, 1}, {50, 5}, {90, 9}, {100, 10}} {
+		if got := h.Percentile(test.p); got != test.want*time.Microsecond {
+			t.Errorf("p%g of 1..10us = %v, want %v", test.p, got, test.want*time.Microsecond)
+		}
+	}
+
+	// larger latencies, on both sides of the edges of buckets, are within 1/subBuckets
+	for _, v := range []uint64{2*subBuckets - 1, 2 * subBuckets, 1023, 1024, 1025, 1000000} {
+		h := new(LatencyHistogram)
+		h.Record(time.Duration(v) * time.Microsecond)
+		// another latency, so that the percentile is not capped by the max
+		h.Record(time.Hour)
+		got := uint64(h.Percentile(50) / time.Microsecond)
+		if diff := math.Abs(float64(got) - float64(v)); diff > float64(v)/subBuckets {
+			t.Errorf("p50 of %dus = %dus, want within %.1f%%", v, got, 100.0/subBuckets)
+		}
+	}
+
+	// the percentile of the highest bucket is not above the max
+	h = new(LatencyHistogram)
+	h.Record(1000 * time.Microsecond)
+	if got := h.Percentile(100); got != 1000*time.Microsecond {
+		t.Errorf("p100 of 1000us = %v", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b, all := new(LatencyHistogram), new(LatencyHistogram), new(LatencyHistogram)
+	for i := 1; i <= 1000; i++ {
+		d := time.Duration(i*i) * time.Microsecond
+		if i%3 == 0 {
+			a.Record(d)
+		} else {
+			b.Record(d)
+		}
+		all.Record(d)
+	}
+	a.Merge(b)
+	if a.Count() != all.Count() || a.Mean() != all.Mean() || a.Max() != all.Max() {
+		t.Errorf("merged: %v, want %v", a, all)
+	}
+	for _, p := range []float64{1, 50, 90, 99, 99.9, 100} {
+		if a.Percentile(p) != all.Percentile(p) {
+			t.Errorf("merged p%g = %v, want %v", p, a.Percentile(p), all.Percentile(p))
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package mongotools
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+// the kinds of operations of a bulk write
+type BulkOpKind int
+
+const (
+	InsertOp BulkOpKind = iota
+	UpdateOp
+	UpsertOp
+	DeleteOp
+)
+
+// the most operations the server accepts in one write command
+const maxWriteBatchSize = 1000
+
+// One operation of a bulk write. See NewInsertOp, NewUpdateOp, NewUpsertOp and NewDeleteOp.
+type BulkOp struct {
+	Kind BulkOpKind
+	// The document to insert
+	Doc interface{}
+	// The documents to update, upsert or delete
+	Selector interface{}
+	// The update to apply, or the replacement document
+	Update interface{}
+	// Whether all documents matching Selector are updated or deleted, instead of only the first
+	Multi bool
+}
+
+// returns an operation inserting doc
+func NewInsertOp(doc interface{}) BulkOp {
+	return BulkOp{Kind: InsertOp, Doc: doc}
+}
+
+// returns an operation applying update to the first document matching selector
+func NewUpdateOp(selector interface{}, update interface{}) BulkOp {
+	return BulkOp{Kind: UpdateOp, Selector: selector, Update: update}
+}
+
+// returns an operation applying update to the first document matching selector,
+// or inserting a document if none matches
+func NewUpsertOp(selector interface{}, update interface{}) BulkOp {
+	return BulkOp{Kind: UpsertOp, Selector: selector, Update: update}
+}
+
+// returns an operation deleting the first document matching selector
+func NewDeleteOp(selector interface{}) BulkOp {
+	return BulkOp{Kind: DeleteOp, Selector: selector}
+}
+
+// The outcome of a bulk write, per operation
+type BulkResult struct {
+	NumInserted int
+	NumUpdated  int // the number of documents matched by updates and upserts that did not insert
+	NumUpserted int // the number of documents inserted by upserts
+	NumDeleted  int
+	// The number of operations that failed, or, in an ordered bulk write, were not
+	// attempted because a previous one failed
+	NumFailed int
+	// the indexes of the operations that failed or were not attempted
+	notDone []int
+}
+
+// returns the operations of ops, the operations the bulk write was given, that failed or were not attempted
+func (res *BulkResult) NotDone(ops []BulkOp) []BulkOp {
+	ret := make([]BulkOp, len(res.notDone))
+	for i, index := range res.notDone {
+		ret[i] = ops[index]
+	}
+	return ret
+}
+
+// records that the operations of indexes first to last-1 were not done
+func (res *BulkResult) fail(first int, last int) {
+	for i := first; i < last; i++ {
+		res.notDone = append(res.notDone, i)
+	}
+	res.NumFailed += last - first
+}
+
+// returns true if the server has the insert, update and delete write commands,
+// which MongoDB has since 2.6. TokuMX does not have them
+func (info *ServerInfo) hasWriteCommands() bool {
+	return !info.IsTokuMX() && info.VersionAtLeast(2, 6)
+}
+
+// BulkWrite runs ops on coll. If ordered is true, the operations are run in order, and
+// none are run after one fails. Otherwise, all operations are attempted, in any order.
+// The returned error is the first that happened, nil if all operations succeeded.
+// The operations that failed are counted in the result, and returned by its NotDone method,
+// so that they may be retried.
+//
+// Servers with write commands run consecutive operations of the same kind in one
+// command. Others (TokuMX, MongoDB before 2.6) run consecutive inserts in one
+// operation, and each other operation on its own.
+func BulkWrite(coll *mgo.Collection, ops []BulkOp, ordered bool) (BulkResult, error) {
+	return bulkWrite(coll, ops, ordered, false)
+}
+
+// runs ops again after a bulk write of them failed, which may have done some of
+// them anyway (e.g. a socket error, or an insert of many documents that failed
+// after inserting the first ones). Each operation is run on its own, and inserts
+// that fail because the document exists are counted as inserted.
+func retryBulkWrite(coll *mgo.Collection, ops []BulkOp, ordered bool) (BulkResult, error) {
+	return bulkWrite(coll, ops, ordered, true)
+}
+
+func bulkWrite(coll *mgo.Collection, ops []BulkOp, ordered bool, retrying bool) (BulkResult, error) {
+	var res BulkResult
+	var firstErr error
+	useCommands := false
+	if !retrying {
+		server, err := GetServerInfo(coll.Database.Session)
+		if err != nil {
+			res.fail(0, len(ops))
+			return res, err
+		}
+		useCommands = server.hasWriteCommands()
+	}
+	for start := 0; start < len(ops); {
+		// the operations from start to end are run together
+		end := start + 1
+		for end < len(ops) && end-start < maxWriteBatchSize && commandName(ops[end].Kind) == commandName(ops[start].Kind) {
+			end++
+		}
+		var err error
+		if useCommands {
+			err = runWriteCommand(coll, ops[start:end], start, ordered, &res)
+		} else {
+			err = runLegacyWrites(coll, ops[start:end], start, ordered, retrying, &res)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		start = end
+		if err != nil && ordered {
+			res.fail(start, len(ops))
+			break
+		}
+	}
+	return res, firstErr
+}
+
+// returns the name of the write command that runs operations of kind
+func commandName(kind BulkOpKind) string {
+	switch kind {
+	case InsertOp:
+		return "insert"
+	case DeleteOp:
+		return "delete"
+	}
+	return "update"
+}
+
+// the result of the insert, update and delete commands
+type writeCommandResult struct {
+	N         int "n"
+	NModified int "nModified"
+	Upserted  []struct {
+		Index int "index"
+	} "upserted"
+	WriteErrors []struct {
+		Index  int    "index"
+		Code   int    "code"
+		ErrMsg string "errmsg"
+	} "writeErrors"
+	WriteConcernError *struct {
+		Code   int    "code"
+		ErrMsg string "errmsg"
+	} "writeConcernError"
+}
+
+// returns the error of a write command, if it had any, as mgo would report it
+func (res *writeCommandResult) err() error {
+	if len(res.WriteErrors) > 0 {
+		return &mgo.QueryError{Code: res.WriteErrors[0].Code, Message: res.WriteErrors[0].ErrMsg}
+	}
+	if res.WriteConcernError != nil {
+		return &mgo.QueryError{Code: res.WriteConcernError.Code, Message: res.WriteConcernError.ErrMsg}
+	}
+	return nil
+}
+
+// returns the write concern of the session, as write commands take it
+func writeConcernDoc(safe *mgo.Safe) bson.D {
+	if safe == nil {
+		return bson.D{{"w", 0}}
+	}
+	var wc bson.D
+	if safe.WMode != "" {
+		wc = append(wc, bson.DocElem{"w", safe.WMode})
+	} else if safe.W > 0 {
+		wc = append(wc, bson.DocElem{"w", safe.W})
+	}
+	if safe.J {
+		wc = append(wc, bson.DocElem{"j", true})
+	}
+	if safe.FSync {
+		wc = append(wc, bson.DocElem{"fsync", true})
+	}
+	if safe.WTimeout > 0 {
+		wc = append(wc, bson.DocElem{"wtimeout", safe.WTimeout})
+	}
+	return wc
+}
+
+// runs ops, which are all run by the same write command, with that command.
+// offset is the index of the first of ops in the bulk write
+func runWriteCommand(coll *mgo.Collection, ops []BulkOp, offset int, ordered bool, res *BulkResult) error {
+	name := commandName(ops[0].Kind)
+	cmd := bson.D{{name, coll.Name}}
+	switch name {
+	case "insert":
+		docs := make([]interface{}, len(ops))
+		for i := range ops {
+			docs[i] = ops[i].Doc
+		}
+		cmd = append(cmd, bson.DocElem{"documents", docs})
+	case "update":
+		updates := make([]bson.M, len(ops))
+		for i, op := range ops {
+			updates[i] = bson.M{"q": op.Selector, "u": op.Update, "upsert": op.Kind == UpsertOp, "multi": op.Multi}
+		}
+		cmd = append(cmd, bson.DocElem{"updates", updates})
+	case "delete":
+		deletes := make([]bson.M, len(ops))
+		for i, op := range ops {
+			limit := 1
+			if op.Multi {
+				limit = 0
+			}
+			deletes[i] = bson.M{"q": op.Selector, "limit": limit}
+		}
+		cmd = append(cmd, bson.DocElem{"deletes", deletes})
+	}
+	safe := coll.Database.Session.Safe()
+	cmd = append(cmd,
+		bson.DocElem{"ordered", ordered},
+		bson.DocElem{"writeConcern", writeConcernDoc(safe)})
+
+	var result writeCommandResult
+	if err := coll.Database.Run(cmd, &result); err != nil {
+		res.fail(offset, offset+len(ops))
+		return err
+	}
+	return res.addWriteCommand(name, len(ops), offset, ordered, safe != nil, &result)
+}
+
+// adds to res the outcome of a write command named name, of numOps operations from offset,
+// whose result is result. If the command was not acknowledged (write concern w:0), its
+// result has no counts, so all operations sent are counted as done, as legacy writes are
+func (res *BulkResult) addWriteCommand(name string, numOps int, offset int, ordered bool, acknowledged bool, result *writeCommandResult) error {
+	if !acknowledged {
+		switch name {
+		case "insert":
+			res.NumInserted += numOps
+		case "update":
+			// whether upserts inserted is unknown
+			res.NumUpdated += numOps
+		case "delete":
+			res.NumDeleted += numOps
+		}
+		return nil
+	}
+	// in an ordered command, the operations after the failed one are not attempted
+	numAttempted := numOps
+	if ordered && len(result.WriteErrors) > 0 {
+		numAttempted = result.WriteErrors[0].Index + 1
+	}
+	for _, e := range result.WriteErrors {
+		res.notDone = append(res.notDone, offset+e.Index)
+	}
+	res.fail(offset+numAttempted, offset+numOps)
+	res.NumFailed += len(result.WriteErrors)
+	switch name {
+	case "insert":
+		res.NumInserted += result.N
+	case "update":
+		res.NumUpserted += len(result.Upserted)
+		res.NumUpdated += result.N - len(result.Upserted)
+	case "delete":
+		res.NumDeleted += result.N
+	}
+	return result.err()
+}
+
+// runs ops, which are all run by the same write command, with the legacy write
+// operations of mgo. offset is the index of the first of ops in the bulk write.
+// If retrying is true, see retryBulkWrite
+func runLegacyWrites(coll *mgo.Collection, ops []BulkOp, offset int, ordered bool, retrying bool, res *BulkResult) error {
+	if ops[0].Kind == InsertOp && !retrying {
+		docs := make([]interface{}, len(ops))
+		for i := range ops {
+			docs[i] = ops[i].Doc
+		}
+		var err error
+		if ordered {
+			err = coll.Insert(docs...)
+		} else {
+			// one insert that continues past the documents that fail
+			bulk := coll.Bulk()
+			bulk.Unordered()
+			bulk.Insert(docs...)
+			_, err = bulk.Run()
+		}
+		// which documents were inserted before an error is unknown, and
+		// on TokuMX, a failed insert inserts none of them
+		if err != nil {
+			res.fail(offset, offset+len(ops))
+			return err
+		}
+		res.NumInserted += len(ops)
+		return nil
+	}
+	var firstErr error
+	for i, op := range ops {
+		var err error
+		var info *mgo.ChangeInfo
+		switch {
+		case op.Kind == InsertOp:
+			err = coll.Insert(op.Doc)
+		case op.Kind == UpsertOp:
+			info, err = coll.Upsert(op.Selector, op.Update)
+		case op.Kind == UpdateOp && op.Multi:
+			info, err = coll.UpdateAll(op.Selector, op.Update)
+		case op.Kind == UpdateOp:
+			if err = coll.Update(op.Selector, op.Update); err == nil {
+				info = &mgo.ChangeInfo{Updated: 1}
+			}
+		case op.Kind == DeleteOp && op.Multi:
+			info, err = coll.RemoveAll(op.Selector)
+		case op.Kind == DeleteOp:
+			if err = coll.Remove(op.Selector); err == nil {
+				info = &mgo.ChangeInfo{Removed: 1}
+			}
+		}
+		if err == mgo.ErrNotFound {
+			// matching no document is not a failure, as with write commands
+			err = nil
+			info = &mgo.ChangeInfo{}
+		}
+		if retrying && op.Kind == InsertOp && mgo.IsDup(err) {
+			// inserted by the attempt that failed
+			err = nil
+		}
+		if err != nil {
+			res.fail(offset+i, offset+i+1)
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ordered {
+				res.fail(offset+i+1, offset+len(ops))
+				return firstErr
+			}
+			continue
+		}
+		res.addLegacyWrite(op.Kind, info)
+	}
+	return firstErr
+}
+
+// adds to res an operation of kind that succeeded with the legacy write operations of mgo,
+// which returned info. Unacknowledged writes (write concern w:0) return no info, and
+// are counted as having changed one document each
+func (res *BulkResult) addLegacyWrite(kind BulkOpKind, info *mgo.ChangeInfo) {
+	switch {
+	case kind == InsertOp:
+		res.NumInserted++
+	case info == nil && kind == DeleteOp:
+		res.NumDeleted++
+	case info == nil:
+		// whether an upsert inserted is unknown
+		res.NumUpdated++
+	case kind == UpsertOp && info.UpsertedId != nil:
+		res.NumUpserted++
+	case kind == DeleteOp:
+		res.NumDeleted += info.Removed
+	default:
+		res.NumUpdated += info.Updated
+	}
+}
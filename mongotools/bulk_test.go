@@ -0,0 +1,68 @@
+package mongotools
+
+import (
+	"labix.org/v2/mgo"
+	"reflect"
+	"testing"
+)
+
+func TestAddWriteCommand(t *testing.T) {
+	writeErrors := []struct {
+		Index  int    "index"
+		Code   int    "code"
+		ErrMsg string "errmsg"
+	}{{1, 11000, "E11000 duplicate key error"}}
+	tests := []struct {
+		name         string
+		ordered      bool
+		acknowledged bool
+		result       writeCommandResult
+		want         BulkResult
+		wantErr      bool
+	}{
+		{"insert", true, true, writeCommandResult{N: 3}, BulkResult{NumInserted: 3}, false},
+		{"insert", true, true, writeCommandResult{N: 1, WriteErrors: writeErrors}, BulkResult{NumInserted: 1, NumFailed: 2, notDone: []int{11, 12}}, true},
+		{"insert", false, true, writeCommandResult{N: 2, WriteErrors: writeErrors}, BulkResult{NumInserted: 2, NumFailed: 1, notDone: []int{11}}, true},
+		{"update", true, true, writeCommandResult{N: 3, Upserted: make([]struct {
+			Index int "index"
+		}, 1)}, BulkResult{NumUpdated: 2, NumUpserted: 1}, false},
+		{"delete", true, true, writeCommandResult{N: 2}, BulkResult{NumDeleted: 2}, false},
+		// unacknowledged commands have no counts, all operations sent are done
+		{"insert", true, false, writeCommandResult{}, BulkResult{NumInserted: 3}, false},
+		{"update", false, false, writeCommandResult{}, BulkResult{NumUpdated: 3}, false},
+		{"delete", true, false, writeCommandResult{}, BulkResult{NumDeleted: 3}, false},
+	}
+	for _, test := range tests {
+		var res BulkResult
+		err := res.addWriteCommand(test.name, 3, 10, test.ordered, test.acknowledged, &test.result)
+		if !reflect.DeepEqual(res, test.want) || (err != nil) != test.wantErr {
+			t.Errorf("%s, ordered %v, acknowledged %v: got %+v, error %v, want %+v", test.name, test.ordered, test.acknowledged, res, err, test.want)
+		}
+	}
+}
+
+func TestAddLegacyWrite(t *testing.T) {
+	tests := []struct {
+		kind BulkOpKind
+		info *mgo.ChangeInfo
+		want BulkResult
+	}{
+		{InsertOp, nil, BulkResult{NumInserted: 1}},
+		{UpdateOp, &mgo.ChangeInfo{Updated: 2}, BulkResult{NumUpdated: 2}},
+		{UpdateOp, &mgo.ChangeInfo{}, BulkResult{}},
+		{UpsertOp, &mgo.ChangeInfo{Updated: 1}, BulkResult{NumUpdated: 1}},
+		{UpsertOp, &mgo.ChangeInfo{UpsertedId: 5}, BulkResult{NumUpserted: 1}},
+		{DeleteOp, &mgo.ChangeInfo{Removed: 3}, BulkResult{NumDeleted: 3}},
+		// unacknowledged writes return no ChangeInfo
+		{UpdateOp, nil, BulkResult{NumUpdated: 1}},
+		{UpsertOp, nil, BulkResult{NumUpdated: 1}},
+		{DeleteOp, nil, BulkResult{NumDeleted: 1}},
+	}
+	for _, test := range tests {
+		var res BulkResult
+		res.addLegacyWrite(test.kind, test.info)
+		if !reflect.DeepEqual(res, test.want) {
+			t.Errorf("kind %d, %+v: got %+v, want %+v", test.kind, test.info, res, test.want)
+		}
+	}
+}
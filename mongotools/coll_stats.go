@@ -0,0 +1,204 @@
+package mongotools
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/Tokutek/go-benchmark"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	doCollStats     = flag.Bool("collStats", true, "log the statistics (count, sizes, compression) of the collections of the benchmark at the start and end of the run, and how they changed")
+	collStatsOutput = flag.String("collStatsOutput", "", "if set, file to write the statistics of the collections at the start and end of each run to, as CSV, one row per collection and run")
+)
+
+// the CSV file of -collStatsOutput, shared by all collStatsMonitors, nil if not set
+var collStatsOut *csv.Writer
+
+// the columns of the CSV file of -collStatsOutput
+var collStatsHeader = []string{"time", "ns",
+	"count before", "count after", "count change",
+	"size before", "size after", "size change",
+	"storageSize before", "storageSize after", "storageSize change",
+	"index storageSize before", "index storageSize after", "index storageSize change",
+	"compression before", "compression after"}
+
+// the statistics of a collection we report, from collStats
+type collStats struct {
+	Count          int64 "count"
+	Size           int64 "size"        // the size of the documents, uncompressed
+	StorageSize    int64 "storageSize" // the size they take on disk
+	TotalIndexSize int64 "totalIndexSize"
+	// on TokuMX, totalIndexSize is uncompressed, and this is the size on disk
+	TotalIndexStorageSize int64 "totalIndexStorageSize"
+	// the size on disk of each index, by name (MongoDB)
+	IndexSizes map[string]int64 "indexSizes"
+	// the sizes of each index (TokuMX). MongoDB has a document of the same name
+	// with engine specific details, so this is decoded by indexStorageSizes
+	IndexDetails bson.Raw "indexDetails"
+}
+
+// returns the size on disk of each index, by name
+func (stats *collStats) indexStorageSizes() map[string]int64 {
+	if len(stats.IndexSizes) > 0 || stats.IndexDetails.Kind != 0x04 {
+		return stats.IndexSizes
+	}
+	var details []struct {
+		Name        string "name"
+		StorageSize int64  "storageSize"
+	}
+	if err := stats.IndexDetails.Unmarshal(&details); err != nil {
+		return nil
+	}
+	ret := make(map[string]int64, len(details))
+	for _, index := range details {
+		ret[index.Name] = index.StorageSize
+	}
+	return ret
+}
+
+// returns the size on disk of all indexes
+func (stats *collStats) indexStorageSize() int64 {
+	if stats.TotalIndexStorageSize > 0 {
+		return stats.TotalIndexStorageSize
+	}
+	return stats.TotalIndexSize
+}
+
+// returns how many times smaller than the documents they store the collection and its
+// indexes are on disk, 0 if unknown. MongoDB reports only the compressed size of indexes,
+// so there this is the compression of the documents only
+func (stats *collStats) compressionRatio() float64 {
+	size, storageSize := stats.Size, stats.StorageSize
+	if stats.TotalIndexStorageSize > 0 {
+		size += stats.TotalIndexSize
+		storageSize += stats.TotalIndexStorageSize
+	}
+	if storageSize == 0 {
+		return 0
+	}
+	return float64(size) / float64(storageSize)
+}
+
+// A benchmark.Monitor taking the statistics of the collections of a benchmark
+// when a run starts and when it ends, and logging them and how they changed,
+// and with -collStatsOutput, writing them to a CSV file
+type collStatsMonitor struct {
+	session *mgo.Session
+	dbname  string
+	colls   []string
+	// nil for the collections whose statistics could not be read
+	before []*collStats
+}
+
+// makes the collections named colls, of the database dbname, have their statistics
+// logged at the start and end of each run, unless -collStats is false
+func addCollStatsMonitor(session *mgo.Session, dbname string, colls []string) {
+	if !*doCollStats || len(colls) == 0 {
+		return
+	}
+	// never closed, as monitors are used until the program ends
+	s := session.Copy()
+	s.SetMode(mgo.Strong, true)
+	if *collStatsOutput != "" && collStatsOut == nil {
+		f, err := os.Create(*collStatsOutput)
+		if err != nil {
+			log.Fatal("Error creating ", *collStatsOutput, ": ", err)
+		}
+		// never closed, as the file is written until the program ends
+		collStatsOut = csv.NewWriter(f)
+		writeCollStatsRow(collStatsHeader)
+	}
+	benchmark.AddMonitor(&collStatsMonitor{session: s, dbname: dbname, colls: colls})
+}
+
+// returns the statistics of each collection, nil for those that could not be read
+func (m *collStatsMonitor) stats() []*collStats {
+	ret := make([]*collStats, len(m.colls))
+	db := m.session.DB(m.dbname)
+	for i, coll := range m.colls {
+		stats := new(collStats)
+		if err := db.Run(bson.D{{"collStats", coll}}, stats); err != nil {
+			log.Println("could not get the statistics of ", m.dbname, ".", coll, ": ", err)
+			continue
+		}
+		ret[i] = stats
+	}
+	return ret
+}
+
+func (m *collStatsMonitor) Start() {
+	m.before = m.stats()
+}
+
+func (m *collStatsMonitor) Stop() {
+	after := m.stats()
+	now := time.Now()
+	for i, coll := range m.colls {
+		ns := m.dbname + "." + coll
+		if m.before[i] == nil || after[i] == nil {
+			// zeros would look like real statistics
+			log.Printf("collStats %s: not available for this run", ns)
+			continue
+		}
+		logCollStats(ns, m.before[i], after[i])
+		if collStatsOut != nil {
+			writeCollStatsRow(collStatsRow(now, ns, m.before[i], after[i]))
+		}
+	}
+}
+
+// returns the row of the CSV file of -collStatsOutput of the collection ns for a run
+// that ended at now, with its statistics before and after the run
+func collStatsRow(now time.Time, ns string, before *collStats, after *collStats) []string {
+	row := []string{now.Format(time.RFC3339), ns}
+	for _, values := range [][2]int64{
+		{before.Count, after.Count},
+		{before.Size, after.Size},
+		{before.StorageSize, after.StorageSize},
+		{before.indexStorageSize(), after.indexStorageSize()}} {
+		row = append(row, strconv.FormatInt(values[0], 10), strconv.FormatInt(values[1], 10), strconv.FormatInt(values[1]-values[0], 10))
+	}
+	return append(row, strconv.FormatFloat(before.compressionRatio(), 'f', 2, 64), strconv.FormatFloat(after.compressionRatio(), 'f', 2, 64))
+}
+
+// writes row to the CSV file of -collStatsOutput
+func writeCollStatsRow(row []string) {
+	collStatsOut.Write(row)
+	collStatsOut.Flush()
+	if err := collStatsOut.Error(); err != nil {
+		log.Fatal("Error writing ", *collStatsOutput, ": ", err)
+	}
+}
+
+// logs the statistics of the collection ns before and after the run, and their difference
+func logCollStats(ns string, before *collStats, after *collStats) {
+	log.Printf("collStats %s: count %d -> %d (%+d), size %d -> %d (%+d), storageSize %d -> %d (%+d), index storageSize %d -> %d (%+d), compression %.2fx -> %.2fx",
+		ns,
+		before.Count, after.Count, after.Count-before.Count,
+		before.Size, after.Size, after.Size-before.Size,
+		before.StorageSize, after.StorageSize, after.StorageSize-before.StorageSize,
+		before.indexStorageSize(), after.indexStorageSize(), after.indexStorageSize()-before.indexStorageSize(),
+		before.compressionRatio(), after.compressionRatio())
+	beforeIndexes, afterIndexes := before.indexStorageSizes(), after.indexStorageSizes()
+	names := make([]string, 0, len(afterIndexes))
+	for name := range afterIndexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sizes := make([]string, len(names))
+	for i, name := range names {
+		sizes[i] = fmt.Sprintf("%s %d -> %d (%+d)", name, beforeIndexes[name], afterIndexes[name], afterIndexes[name]-beforeIndexes[name])
+	}
+	if len(sizes) > 0 {
+		log.Printf("collStats %s: index storageSizes: %s", ns, strings.Join(sizes, ", "))
+	}
+}
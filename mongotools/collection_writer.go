@@ -3,99 +3,276 @@ package mongotools
 import (
 	"flag"
 	"github.com/Tokutek/go-benchmark"
-	"github.com/Tokutek/go-benchmark/benchmarks/iibench"
 	"labix.org/v2/mgo"
 	"log"
+	"sync"
+	"time"
 )
 
+// command line variables for the inserts of a benchmark, read by InsertOptionsFromFlags
 var (
 	docsPerInsert      = flag.Int("docsPerInsert", 1000, "specify the number of documents per insert")
 	insertsPerInterval = flag.Int("insertsPerInterval", 0, "max inserts per interval, 0 means unlimited")
 	insertInterval     = flag.Int("insertInterval", 1, "interval for inserts, in seconds, meant to be used with -insertsPerInterval")
+	numGenerators      = flag.Int("numGenerators", 1, "number of threads generating the documents of each writer, for benchmarks whose documents are expensive to generate")
+	generatorSeed      = flag.Int64("generatorSeed", 0, "with -numGenerators > 1, seed of the random numbers of the generators, 0 means one based on the time")
+	unorderedInserts   = flag.Bool("unorderedInserts", false, "if true, when a document of a batch fails to be inserted, the following documents of the batch are still inserted")
 )
 
-var minBatchSizeForChannel = 50
-
 type DocGenerator interface {
 	Generate() interface{}
 }
 
+// A DocGenerator that also generates operations other than inserts implements OpGenerator.
+// NewInsertWork then fills its batches with GenerateOp instead of Generate, so that one
+// batch may mix inserts, updates, upserts and deletes. NumInserts then counts operations.
+type OpGenerator interface {
+	DocGenerator
+	GenerateOp() BulkOp
+}
+
+// A DocGenerator whose documents can be generated by many threads implements ParallelDocGenerator.
+// Split returns the generator of thread i of n, whose random numbers are drawn from a source
+// seeded with seed, so that a run can be reproduced. The documents of the n generators must
+// together be those of a single generator, for instance by interleaving their ids.
+type ParallelDocGenerator interface {
+	DocGenerator
+	Split(i int, n int, seed int64) DocGenerator
+}
+
+// Defines the inserts of a Work made by NewInsertWork
+//
+// Example, for a Work inserting one million documents in batches of 100,
+// at most 5000 documents per second:
+//
+//     options := mongotools.InsertOptions{DocsPerInsert: 100, InsertsPerInterval: 5000, Interval: 1, NumInserts: 1000000, Retry: mongotools.DefaultRetryPolicy()}
+//     workInfo := mongotools.NewInsertWork(gen, coll, options)
+type InsertOptions struct {
+	// The number of documents inserted by each operation
+	DocsPerInsert int
+	// The maximum number of documents inserted per Interval, 0 means unlimited
+	InsertsPerInterval int
+	// The interval InsertsPerInterval applies to, in seconds
+	Interval int
+	// The number of documents to insert, 0 means unlimited, the benchmark then being bounded by time
+	NumInserts int
+	// If true, when an operation of a batch fails, the following operations of the batch are still run
+	Unordered bool
+	// The number of threads generating the documents, 0 meaning 1. The DocGenerator
+	// must be a ParallelDocGenerator if it is greater than 1
+	NumGenerators int
+	// The seed the random numbers of the generators derive from, if NumGenerators is
+	// greater than 1. 0 means a seed based on the time
+	Seed int64
+	// The write concern of the inserts. nil means that of the session of the collection
+	WriteConcern *mgo.Safe
+	// How inserts that fail with a retryable error are retried
+	Retry RetryPolicy
+}
+
+// returns the InsertOptions defined by the command line flags "docsPerInsert",
+// "insertsPerInterval", "insertInterval", "unorderedInserts", "numGenerators" and "generatorSeed", inserting numInserts
+// documents (0 meaning unlimited), retrying as defined by DefaultRetryPolicy.
+// The write concern is left to the session, as set by ApplySessionOptions
+func InsertOptionsFromFlags(numInserts int) InsertOptions {
+	return InsertOptions{
+		DocsPerInsert:      *docsPerInsert,
+		InsertsPerInterval: *insertsPerInterval,
+		Interval:           *insertInterval,
+		NumInserts:         numInserts,
+		Unordered:          *unorderedInserts,
+		NumGenerators:      *numGenerators,
+		Seed:               *generatorSeed,
+		Retry:              DefaultRetryPolicy()}
+}
+
+// The results the Work made by NewInsertWork records. As with any result, they are
+// added to the fields of the same name of the metric sample of the benchmark (see
+// benchmark.Recorder), such as iibench.Result, and fields the sample lacks are ignored.
+type InsertResult struct {
+	NumInserts   uint64
+	NumRetries   uint64
+	NumUpdates   uint64
+	NumUpserts   uint64
+	NumDeletes   uint64
+	NumFailedOps uint64
+}
+
 // implements Work
 type insertWork struct {
-	coll *mgo.Collection
-	ch   <-chan []interface{}
-	kill chan<- bool
+	coll      *mgo.Collection
+	ch        <-chan []BulkOp
+	kill      chan<- bool
+	retry     RetryPolicy
+	unordered bool
+	// the number of documents of a full batch
+	docsPerInsert int
+	// the session made for the write concern of the inserts, nil if none was
+	session *mgo.Session
 }
 
-func (w *insertWork) Do(c chan<- interface{}) {
-	numInserted := 0
-	// if docsPerInsert is less than 50, we want
-	// to batch the operations before sending it over a channel
-	// This is an attempt to get 10% back from iibench
-	// when docsPerInsert=1
-	for numInserted < minBatchSizeForChannel {
-		docs := <-w.ch
-		err := w.coll.Insert(docs...)
+// runs one batch of operations with a bulk write. When the bulk write fails
+// with a retryable error, the operations that were not done are retried
+func (w *insertWork) Do(r *benchmark.Recorder) {
+	ops, ok := <-w.ch
+	if !ok {
+		// all NumInserts documents were inserted
+		return
+	}
+	if len(ops) < w.docsPerInsert {
+		log.Println("inserting the final partial batch of ", len(ops), " documents")
+	}
+	var total BulkResult
+	attempts := 0
+	retries, err := w.retry.Do(func() error {
+		var res BulkResult
+		var err error
+		if attempts == 0 {
+			res, err = BulkWrite(w.coll, ops, !w.unordered)
+		} else {
+			// some of the operations not known to be done may have been
+			// done before the error, so inserting them again must not fail
+			res, err = retryBulkWrite(w.coll, ops, !w.unordered)
+		}
+		attempts++
+		total.NumInserted += res.NumInserted
+		total.NumUpdated += res.NumUpdated
+		total.NumUpserted += res.NumUpserted
+		total.NumDeleted += res.NumDeleted
 		if err != nil {
-			log.Print("received error ", err)
+			ops = res.NotDone(ops)
 		}
-		numInserted += len(docs)
+		return err
+	})
+	if err != nil {
+		log.Print("received error ", err)
+		total.NumFailed = len(ops)
 	}
-	c <- iibench.Result{NumInserts: uint64(numInserted)}
+	r.Add(InsertResult{
+		NumInserts:   uint64(total.NumInserted),
+		NumUpdates:   uint64(total.NumUpdated),
+		NumUpserts:   uint64(total.NumUpserted),
+		NumDeletes:   uint64(total.NumDeleted),
+		NumFailedOps: uint64(total.NumFailed),
+		NumRetries:   uint64(retries)})
 }
 
 func (w *insertWork) Close() {
-	w.kill <- true
+	// the generator may already be done, so it is not sent to but closed
 	close(w.kill)
+	if w.session != nil {
+		w.session.Close()
+	}
 }
 
 // returns a WorkInfo that can be used for loading documents into a collection
 // This is essentially a helper function for the purpose of loading data into collections,
 // be it an iibench writer or a sysbench trickle loader. The caller defines how to generate
-// the documents, via the DocGenerator passed in, and how many insertions the WorkInfo is to
-// do (with 0 meaning unlimited and that the benchmark is bounded by time), and a WorkInfo is returned
-// This file exports flags "docsPerInsert" that defines the batching of the writer, "insertsPerInterval" and "insertInterval"
-// to define whether there should be any gating.
-func NewInsertWork(gen DocGenerator, coll *mgo.Collection, numInsertsPerThread int) benchmark.WorkInfo {
+// the documents, via the DocGenerator passed in, and how the documents are inserted
+// (batching, gating, how many insertions the WorkInfo is to do, ...) via the InsertOptions
+// passed in, and a WorkInfo is returned. Benchmarks that take these options from
+// the command line use InsertOptionsFromFlags.
+func NewInsertWork(gen DocGenerator, coll *mgo.Collection, options InsertOptions) benchmark.WorkInfo {
+	if options.DocsPerInsert <= 0 {
+		log.Fatal("invalid number of documents per insert: ", options.DocsPerInsert)
+	}
+	if options.NumInserts < 0 {
+		log.Fatal("invalid number of inserts: ", options.NumInserts)
+	}
+	numGenerators := options.NumGenerators
+	if numGenerators <= 0 {
+		numGenerators = 1
+	}
+	gens := []DocGenerator{gen}
+	if numGenerators > 1 {
+		parallel, ok := gen.(ParallelDocGenerator)
+		if !ok {
+			log.Fatal("the documents of this benchmark cannot be generated by more than one thread")
+		}
+		seed := options.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		gens = make([]DocGenerator, numGenerators)
+		for i := range gens {
+			gens[i] = parallel.Split(i, numGenerators, seed+int64(i))
+		}
+	}
 	kill := make(chan bool)
-	ch := make(chan []interface{}, 10)
-	go func() {
-		defer close(ch)
-		dpi := *docsPerInsert
-		for {
-			docs := make([]interface{}, dpi)
-			for i := range docs {
-				docs[i] = gen.Generate()
-			}
-			select {
-			case <-kill:
-				return
-			case ch <- docs:
-			}
+	ch := make(chan []BulkOp, 10*numGenerators)
+	var generating sync.WaitGroup
+	numOps := 0
+	for i := range gens {
+		// the number of documents generated by this generator, if NumInserts is set:
+		// an equal share of them, one more for the first generators if they do not divide evenly
+		share := options.NumInserts / numGenerators
+		if i < options.NumInserts%numGenerators {
+			share++
 		}
-	}()
-	writer := &insertWork{coll, ch, kill}
-	var (
-		numOps         int
-		opsPerInterval int
-	)
-	if *insertsPerInterval > 0 && *insertsPerInterval < minBatchSizeForChannel {
-		minBatchSizeForChannel = *insertsPerInterval
+		// each operation is the insertion of one batch, the last of which
+		// is partial if share is not a multiple of DocsPerInsert
+		numOps += (share + options.DocsPerInsert - 1) / options.DocsPerInsert
+		if last := share % options.DocsPerInsert; last != 0 {
+			log.Println("the last batch of generator ", i, " will have ", last, " documents")
+		}
+		generating.Add(1)
+		go generateBatches(gens[i], options.DocsPerInsert, options.NumInserts > 0, share, ch, kill, &generating)
 	}
-	if numInsertsPerThread > 0 && numInsertsPerThread < minBatchSizeForChannel {
-		minBatchSizeForChannel = numInsertsPerThread
+	go func() {
+		generating.Wait()
+		close(ch)
+	}()
+	var session *mgo.Session
+	if options.WriteConcern != nil {
+		// so that the write concern does not change that of the session of coll
+		session = coll.Database.Session.Copy()
+		session.SetSafe(options.WriteConcern)
+		coll = coll.With(session)
 	}
-	if *docsPerInsert < minBatchSizeForChannel && minBatchSizeForChannel%*docsPerInsert != 0 {
-		log.Fatal("If you want DocsPerInterval < ", minBatchSizeForChannel, ", make it divisible by ", minBatchSizeForChannel)
+	retry := options.Retry
+	onRetry := retry.OnRetry
+	retry.OnRetry = func(err error) {
+		// socket errors leave the session unusable until it is refreshed
+		if IsSocketError(err) {
+			coll.Database.Session.Refresh()
+		}
+		if onRetry != nil {
+			onRetry(err)
+		}
 	}
-	if *docsPerInsert < minBatchSizeForChannel {
-		numOps = numInsertsPerThread / minBatchSizeForChannel
-		opsPerInterval = *insertsPerInterval / minBatchSizeForChannel
-	} else {
-		numOps = numInsertsPerThread / *docsPerInsert
-		opsPerInterval = *insertsPerInterval / *docsPerInsert
+	writer := &insertWork{coll, ch, kill, retry, options.Unordered, options.DocsPerInsert, session}
+	opsPerInterval := options.InsertsPerInterval / options.DocsPerInsert
+	if options.InsertsPerInterval > 0 && opsPerInterval == 0 {
+		log.Println("insertsPerInterval is less than one batch, inserting one batch per interval")
+		opsPerInterval = 1
 	}
 	log.Println("opsPerInterval ", opsPerInterval, " numOps ", numOps)
-	workInfo := benchmark.WorkInfo{writer, uint64(opsPerInterval), uint64(*insertInterval), uint64(numOps)}
+	workInfo := benchmark.WorkInfo{writer, uint64(opsPerInterval), uint64(options.Interval), uint64(numOps)}
 	return workInfo
 }
+
+// generates batches of dpi operations with gen, and sends them over ch until kill
+// is closed, or if limited is true, until numDocs documents were generated
+func generateBatches(gen DocGenerator, dpi int, limited bool, numDocs int, ch chan<- []BulkOp, kill <-chan bool, generating *sync.WaitGroup) {
+	defer generating.Done()
+	opGen, isOpGen := gen.(OpGenerator)
+	for !limited || numDocs > 0 {
+		if limited && numDocs < dpi {
+			dpi = numDocs
+		}
+		numDocs -= dpi
+		ops := make([]BulkOp, dpi)
+		for i := range ops {
+			if isOpGen {
+				ops[i] = opGen.GenerateOp()
+			} else {
+				ops[i] = NewInsertOp(gen.Generate())
+			}
+		}
+		select {
+		case <-kill:
+			return
+		case ch <- ops:
+		}
+	}
+}
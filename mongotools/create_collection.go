@@ -6,15 +6,20 @@ import (
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"log"
+	"strings"
 )
 
 // command line variables for creating collections
 var (
-	doCreate     = flag.Bool("create", false, "whether the test should create the collection")
-	nodeSize     = flag.Int("nodeSize", 4*1024*1024, "specify the node size of all indexes in the collection, only takes affect if -create is true")
-	basementSize = flag.Int("basementSize", 64*1024, "specify the basement node size of all indexes in the collection, only takes affect if -create is true")
-	compression  = flag.String("compression", zlib, "specify compression type of all indexes in the collection. Only takes affect if -create is true. Can be \"zlib\", \"lzma\", \"quicklz\", or \"none\"")
-	partition    = flag.Bool("partition", false, "whether to partition the collections on create")
+	doCreate           = flag.Bool("create", false, "whether the test should create the collection")
+	nodeSize           = flag.Int("nodeSize", 4*1024*1024, "specify the node size of all indexes in the collection, only takes affect if -create is true")
+	basementSize       = flag.Int("basementSize", 64*1024, "specify the basement node size of all indexes in the collection, only takes affect if -create is true")
+	compression        = flag.String("compression", zlib, "specify compression type of all indexes in the collection. Only takes affect if -create is true. Can be \"zlib\", \"lzma\", \"quicklz\", or \"none\"")
+	partition          = flag.Bool("partition", false, "whether to partition the collections on create")
+	doRecreate         = flag.Bool("recreate", false, "whether the test should drop the collections if they exist, and create them as -create does")
+	doRecreateDatabase = flag.Bool("recreateDatabase", false, "with -recreate, drop the whole database before creating the collections")
+	doEnsure           = flag.Bool("ensure", false, "whether the test should create only the collections that do not exist, using the existing ones as they are")
+	primaryKey         = flag.String("primaryKey", "", "comma separated fields of the primary key TokuMX clusters the collections on when creating them, e.g. \"ts,_id\". Must end with \"_id\". Empty means the benchmark's preferred primary key, which by default is _id")
 )
 
 //////////////////////////////////////////////////////////////////
@@ -30,13 +35,26 @@ func GetCollectionString(collname string, i int) string {
 }
 
 // options for creating a collection
-// TODO: add an option for primary key
 type createCollOptions struct {
 	Coll         string "create"
 	Compression  string "compression,omitempty"
 	NodeSize     int    "pageSize,omitempty"
 	BasementSize int    "readPageSize,omitempty"
 	Partitioned  bool   "partitioned,omitempty"
+	PrimaryKey   bson.D "primaryKey,omitempty"
+}
+
+// Describes the collections a benchmark needs, for MakeCollectionsWithOptions
+type CollectionOptions struct {
+	// The indexes created on each collection. See IndexSpecs to make them from plain mgo.Index values
+	Indexes []IndexSpec
+	// The primary key the benchmark prefers its collections to be clustered on,
+	// in the format of mgo.Index.Key (e.g. []string{"ts", "_id"}). It must end
+	// with "_id". Only TokuMX supports this, so it is ignored for MongoDB.
+	// nil means the default primary key, {_id: 1}. The primaryKey flag, if set, overrides it.
+	PrimaryKey []string
+	// How the collections are sharded when created, on a sharded cluster. See ShardingOptions
+	Sharding ShardingOptions
 }
 
 const (
@@ -55,6 +73,7 @@ type tokuMXCreateOptions struct {
 	NodeSize        int
 	BasementSize    int
 	Partitioned     bool
+	PrimaryKey      bson.D // nil means the default of {_id: 1}
 }
 
 func getDefaultCreateOptions() (ret tokuMXCreateOptions) {
@@ -84,18 +103,26 @@ func createTokuCollection(collname string, db *mgo.Database, options tokuMXCreat
 		Compression:  options.CompressionType,
 		NodeSize:     options.NodeSize,
 		BasementSize: options.BasementSize,
-		Partitioned:  options.Partitioned}
+		Partitioned:  options.Partitioned,
+		PrimaryKey:   options.PrimaryKey}
 	err := db.Run(createCmd, &result)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-// returns true if the collection already exists. Does so
-// by querying db.system.namespaces to see if the collection
-// is listed
+// returns true if the collection already exists. Does so with the
+// listCollections command if the server has it, otherwise by querying
+// db.system.namespaces to see if the collection is listed
 func collectionExists(s *mgo.Session, dbname string, collname string) bool {
 	db := s.DB(dbname)
+	if mustGetServerInfo(s).hasListCommands() {
+		var result cursorResult
+		if err := db.Run(bson.D{{"listCollections", 1}, {"filter", bson.M{"name": collname}}}, &result); err != nil {
+			log.Fatal("Received error ", err, " when running listCollections, exiting")
+		}
+		return len(result.Cursor.FirstBatch) > 0
+	}
 	sysNamespaces := db.C("system.namespaces")
 	coll := db.C(collname)
 	q := sysNamespaces.Find(bson.M{"name": coll.FullName})
@@ -106,11 +133,13 @@ func collectionExists(s *mgo.Session, dbname string, collname string) bool {
 	return n > 0
 }
 
-func applyTokuIndexOptions(db *mgo.Database, collname string, options tokuMXCreateOptions) {
+// sets the TokuMX options of the index named indexName, or of all indexes
+// of the collection if indexName is "*"
+func applyTokuIndexOptions(db *mgo.Database, collname string, indexName string, options tokuMXCreateOptions) {
 	var result bson.M
 	var optBson bson.M
-	optBson = bson.M{"compression": options.CompressionType , "pageSize" : options.NodeSize, "readPageSize" : options.BasementSize}
-	err := db.Run(bson.D{{"reIndex", collname}, {"index", "*"}, {"options" , optBson}}, &result)
+	optBson = bson.M{"compression": options.CompressionType, "pageSize": options.NodeSize, "readPageSize": options.BasementSize}
+	err := db.Run(bson.D{{"reIndex", collname}, {"index", indexName}, {"options", optBson}}, &result)
 	if err != nil {
 		log.Fatal("Failed to set options on indexes, received ", err)
 	}
@@ -118,25 +147,52 @@ func applyTokuIndexOptions(db *mgo.Database, collname string, options tokuMXCrea
 
 // Creates a collection, but first checks if the collection exists. If it does,
 // we log a fatal error and end the program
-func createCollection(s *mgo.Session, dbname string, collname string, tokuOptions tokuMXCreateOptions, indexes []mgo.Index) {
+func createCollection(s *mgo.Session, dbname string, collname string, tokuOptions tokuMXCreateOptions, indexes []IndexSpec) {
 	db := s.DB(dbname)
 	coll := db.C(collname)
 	if collectionExists(s, dbname, collname) {
-		log.Fatal(coll.FullName, " exists, found in system.namespaces, run without -create")
+		log.Fatal(coll.FullName, " exists, run without -create")
 	}
-	if IsTokuMX(db) {
+	isToku := IsTokuMX(db)
+	if isToku {
 		createTokuCollection(collname, db, tokuOptions)
 	} else {
 		createMongoCollection(collname, db)
 	}
 	for x := range indexes {
-		err := coll.EnsureIndex(indexes[x])
-		if err != nil {
-			log.Fatal("Received error ", err, " when adding index ", indexes[x])
+		createIndex(db, collname, indexes[x], isToku)
+	}
+	if isToku {
+		// first give every index the options of the collection, then
+		// override them for the indexes that have their own
+		applyTokuIndexOptions(db, collname, "*", tokuOptions)
+		for x := range indexes {
+			applyIndexSpecOptions(db, collname, indexes[x], tokuOptions)
+		}
+	}
+}
+
+// drops a collection, logging a fatal error if that fails
+func dropCollection(s *mgo.Session, dbname string, collname string) {
+	fmt.Println("dropping collection: ", collname)
+	if err := s.DB(dbname).C(collname).DropCollection(); err != nil {
+		log.Fatal("Received error ", err, " when dropping ", dbname, ".", collname)
+	}
+}
+
+// verifies that at most one of the create, recreate and ensure flags is set
+func verifyCreateMode() {
+	numModes := 0
+	for _, mode := range []bool{*doCreate, *doRecreate, *doEnsure} {
+		if mode {
+			numModes++
 		}
 	}
-	if IsTokuMX(db) {
-		applyTokuIndexOptions(db, collname, tokuOptions)
+	if numModes > 1 {
+		log.Fatal("at most one of -create, -recreate and -ensure may be set")
+	}
+	if *doRecreateDatabase && !*doRecreate {
+		log.Fatal("-recreateDatabase may only be used with -recreate")
 	}
 }
 
@@ -149,26 +205,108 @@ func createCollection(s *mgo.Session, dbname string, collname string, tokuOption
 // If either of these collections already exist, then a fatal
 // error is logged and the program ends. If the create flag is set to false, then this function
 // ensures that the specified collections ("dbb.coll_0" and "dbb.coll_1" in the example) already exist.
-// We do NOT verify that the indexes passed into this function match the existing indexes of the collection
+// If the verifyIndexes flag is set, it also verifies that the existing collections have the indexes passed
+// in, building the missing ones if the buildMissingIndexes flag is set (see verifyIndexes).
+//
+// Two other modes save scripts from cleaning up between runs. If the recreate flag is set, collections
+// that exist are dropped and all collections are created as with the create flag (with the recreateDatabase
+// flag, the whole database is dropped first). If the ensure flag is set, only the collections that do not exist
+// are created, and the existing ones are used as with the create flag set to false.
 func MakeCollections(collname string, dbname string, numCollections int, session *mgo.Session, indexes []mgo.Index) {
+	MakeCollectionsWithOptions(collname, dbname, numCollections, session, CollectionOptions{Indexes: IndexSpecs(indexes...)})
+}
+
+// returns the primary key document for key, in the format of mgo.Index.Key,
+// after verifying that it ends with _id as TokuMX requires. Returns nil if key is empty
+func primaryKeyDoc(key []string) bson.D {
+	if len(key) == 0 {
+		return nil
+	}
+	_, doc := indexKey(key)
+	if doc[len(doc)-1].Name != "_id" {
+		log.Fatal("invalid primary key ", key, ", the last field must be _id")
+	}
+	return doc
+}
+
+// Works like MakeCollections, with the collections described by options. See CollectionOptions.
+// Unless the collStats flag is false, the statistics of the collections are logged at the start
+// and end of each run of the benchmark (see benchmark.Monitor).
+func MakeCollectionsWithOptions(collname string, dbname string, numCollections int, session *mgo.Session, options CollectionOptions) {
 	if !validCompressionType(*compression) {
 		log.Fatal("invalid value for compression: ", *compression)
 	}
+	// collections are created and verified on the primary, whatever the read preference of the benchmark
+	session = session.Copy()
+	defer session.Close()
+	session.SetMode(mgo.Strong, true)
+	server := mustGetServerInfo(session)
+	log.Println("server: ", server)
+	indexes := options.Indexes
+	for _, index := range indexes {
+		if index.Compression != "" && !validCompressionType(index.Compression) {
+			log.Fatal("invalid compression for index ", index.Key, ": ", index.Compression)
+		}
+	}
+	pk := options.PrimaryKey
+	if *primaryKey != "" {
+		if !server.IsTokuMX() {
+			log.Fatal("-primaryKey is only supported by TokuMX")
+		}
+		pk = strings.Split(*primaryKey, ",")
+	} else if len(pk) > 0 && !server.IsTokuMX() {
+		log.Println("MongoDB does not support clustering on a primary key, ignoring primary key ", pk)
+		pk = nil
+	}
+	sharding := shardingFromFlags(options.Sharding)
+	if (len(sharding.Key) > 0 || sharding.WaitForBalancer) && !server.IsMongos {
+		log.Fatal("sharding the collections, and waiting for the balancer, require connecting to the mongos of a sharded cluster")
+	}
+	verifyCreateMode()
+	if *doRecreateDatabase {
+		fmt.Println("dropping database: ", dbname)
+		if err := session.DB(dbname).DropDatabase(); err != nil {
+			log.Fatal("Received error ", err, " when dropping database ", dbname)
+		}
+	}
+	if len(sharding.Key) > 0 && (*doCreate || *doRecreate || *doEnsure) {
+		enableSharding(session, dbname)
+	}
+	tokuOptions := tokuMXCreateOptions{*compression, *nodeSize, *basementSize, *partition, primaryKeyDoc(pk)}
+	colls := make([]string, 0, numCollections)
 	for i := 0; i < numCollections; i++ {
 		currCollectionString := GetCollectionString(collname, i)
-		if *doCreate {
-			createCollection(session, dbname, currCollectionString, tokuMXCreateOptions{*compression, *nodeSize, *basementSize, *partition}, indexes)
-		} else if !collectionExists(session, dbname, currCollectionString) {
-			log.Fatal("Collection ", dbname, ".", currCollectionString, " does not exist. Run with -create=true")
+		colls = append(colls, currCollectionString)
+		exists := false
+		if !*doCreate {
+			exists = collectionExists(session, dbname, currCollectionString)
 		}
+		if *doRecreate && exists {
+			dropCollection(session, dbname, currCollectionString)
+			exists = false
+		}
+		if *doCreate || *doRecreate || (*doEnsure && !exists) {
+			createCollection(session, dbname, currCollectionString, tokuOptions, indexes)
+			if len(sharding.Key) > 0 {
+				shardCollection(session, dbname, currCollectionString, sharding)
+			}
+		} else if !exists {
+			log.Fatal("Collection ", dbname, ".", currCollectionString, " does not exist. Run with -create=true or -ensure=true")
+		} else if *doVerifyIndexes {
+			verifyIndexes(session, dbname, currCollectionString, tokuOptions, indexes)
+		}
+	}
+	if sharding.WaitForBalancer {
+		waitForBalancerToSettle(session)
 	}
+	addCollStatsMonitor(session, dbname, colls)
 }
 
 // Ensures that the benchmark was started (and MakeCollections will be called) with the assumption
 // that the collections are not to be created. Currently used in sysbench, where we assume the benchmark
 // is run on preloaded collections.
 func VerifyNotCreating() {
-	if *doCreate {
-		log.Fatal("This application should not be creating collections, it should be using existing collections, -create must be false")
+	if *doCreate || *doRecreate || *doEnsure {
+		log.Fatal("This application should not be creating collections, it should be using existing collections, -create, -recreate and -ensure must be false")
 	}
 }
@@ -0,0 +1,348 @@
+package mongotools
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Datasets are files of documents, made by WriteDataset and replayed by FileDocGenerator,
+// so that the same documents may be loaded into different servers without the cost
+// and randomness of generating them. They come in two formats:
+//
+// "bson": the documents one after another, as BSON, like mongodump writes them
+//
+// "json": one document per line, as MongoDB extended JSON, in which dates, object ids,
+// 64-bit integers and binary data are written as {"$date": <milliseconds>}, {"$oid": <hex>},
+// {"$numberLong": "<integer>"} and {"$binary": <base64>, "$type": "<hex subtype>"}
+
+// returns the format of a dataset file from its extension: "json" for .json and .jsonl files, "bson" otherwise
+func DatasetFormat(path string) string {
+	if strings.HasSuffix(path, ".json") || strings.HasSuffix(path, ".jsonl") {
+		return "json"
+	}
+	return "bson"
+}
+
+// WriteDataset writes numDocs documents made by gen to w, in format, which is "bson" or "json".
+func WriteDataset(w io.Writer, gen DocGenerator, numDocs int, format string) error {
+	if format != "bson" && format != "json" {
+		return errors.New("invalid dataset format " + format)
+	}
+	buf := bufio.NewWriter(w)
+	for i := 0; i < numDocs; i++ {
+		data, err := bson.Marshal(gen.Generate())
+		if err != nil {
+			return err
+		}
+		if format == "bson" {
+			_, err = buf.Write(data)
+		} else {
+			err = writeJSONDoc(buf, data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// writes the BSON document data as a line of extended JSON
+func writeJSONDoc(w *bufio.Writer, data []byte) error {
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	var line bytes.Buffer
+	if err := appendJSON(&line, doc); err != nil {
+		return err
+	}
+	line.WriteByte('\n')
+	_, err := w.Write(line.Bytes())
+	return err
+}
+
+// appends v, a value unmarshalled from BSON, to b as extended JSON
+func appendJSON(b *bytes.Buffer, v interface{}) error {
+	switch x := v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(x))
+	case int:
+		b.WriteString(strconv.Itoa(x))
+	case int64:
+		fmt.Fprintf(b, `{"$numberLong": "%d"}`, x)
+	case float64:
+		if math.IsInf(x, 0) || math.IsNaN(x) {
+			return fmt.Errorf("cannot write %v as JSON", x)
+		}
+		s := strconv.FormatFloat(x, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eE") {
+			// so that it is read back as a double, not an integer
+			s += ".0"
+		}
+		b.WriteString(s)
+	case string:
+		s, _ := json.Marshal(x)
+		b.Write(s)
+	case time.Time:
+		fmt.Fprintf(b, `{"$date": %d}`, x.UnixNano()/int64(time.Millisecond))
+	case bson.ObjectId:
+		fmt.Fprintf(b, `{"$oid": "%s"}`, x.Hex())
+	case []byte:
+		return appendJSON(b, bson.Binary{Kind: 0x00, Data: x})
+	case bson.Binary:
+		fmt.Fprintf(b, `{"$binary": "%s", "$type": "%02x"}`, base64.StdEncoding.EncodeToString(x.Data), x.Kind)
+	case bson.D:
+		b.WriteByte('{')
+		for i, elem := range x {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			name, _ := json.Marshal(elem.Name)
+			b.Write(name)
+			b.WriteString(": ")
+			if err := appendJSON(b, elem.Value); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+	case bson.M:
+		// nested documents are unmarshalled as bson.M if the outer one is not a bson.D
+		d := make(bson.D, 0, len(x))
+		for name, value := range x {
+			d = append(d, bson.DocElem{name, value})
+		}
+		return appendJSON(b, d)
+	case []interface{}:
+		b.WriteByte('[')
+		for i, elem := range x {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			if err := appendJSON(b, elem); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	default:
+		return fmt.Errorf("cannot write values of type %T to a JSON dataset", v)
+	}
+	return nil
+}
+
+// reads the next value from dec, converting extended JSON to the values BSON has
+func readJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			arr := []interface{}{}
+			for dec.More() {
+				v, err := readJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, v)
+			}
+			_, err = dec.Token()
+			return arr, err
+		}
+		var doc bson.D
+		for dec.More() {
+			nameTok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			v, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			doc = append(doc, bson.DocElem{nameTok.(string), v})
+		}
+		if _, err = dec.Token(); err != nil {
+			return nil, err
+		}
+		return fromExtendedJSON(doc)
+	case json.Number:
+		s := string(t)
+		if strings.ContainsAny(s, ".eE") {
+			return t.Float64()
+		}
+		n, err := t.Int64()
+		if err != nil {
+			return nil, errors.New("invalid integer " + s + " in JSON dataset")
+		}
+		if n > math.MaxInt32 || n < math.MinInt32 {
+			return n, nil
+		}
+		return int(n), nil
+	}
+	// strings, bools and nulls
+	return tok, nil
+}
+
+// converts doc into the value it stands for if it is one of the extended JSON documents
+func fromExtendedJSON(doc bson.D) (interface{}, error) {
+	if len(doc) == 0 || !strings.HasPrefix(doc[0].Name, "$") {
+		return doc, nil
+	}
+	switch {
+	case len(doc) == 1 && doc[0].Name == "$date":
+		var ms int64
+		switch n := doc[0].Value.(type) {
+		case int:
+			ms = int64(n)
+		case int64:
+			ms = n
+		default:
+			return nil, errors.New("invalid $date in JSON dataset")
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	case len(doc) == 1 && doc[0].Name == "$numberLong":
+		// a nested extended JSON document, so already converted
+		if n, ok := doc[0].Value.(int64); ok {
+			return n, nil
+		}
+		s, _ := doc[0].Value.(string)
+		return strconv.ParseInt(s, 10, 64)
+	case len(doc) == 1 && doc[0].Name == "$oid":
+		s, _ := doc[0].Value.(string)
+		if !bson.IsObjectIdHex(s) {
+			return nil, errors.New("invalid $oid in JSON dataset")
+		}
+		return bson.ObjectIdHex(s), nil
+	case len(doc) == 2 && doc[0].Name == "$binary" && doc[1].Name == "$type":
+		s, _ := doc[0].Value.(string)
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		kindStr, _ := doc[1].Value.(string)
+		kind, err := strconv.ParseUint(kindStr, 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		return bson.Binary{Kind: byte(kind), Data: data}, nil
+	}
+	return doc, nil
+}
+
+// A DocGenerator that replays the documents of a dataset file written by WriteDataset,
+// in order. Running out of documents is fatal, unless it replays the file, in which
+// case it starts over from the first document, which only works for documents without _id.
+// BSON datasets are inserted without decoding their documents.
+type FileDocGenerator struct {
+	path   string
+	format string
+	file   *os.File
+	reader *bufio.Reader
+	dec    *json.Decoder
+	replay bool
+	// the number of documents replayed so far
+	numDocs uint64
+}
+
+// returns a FileDocGenerator replaying the dataset at path, in format, "bson" or "json".
+// An empty format means the one of the extension of path (see DatasetFormat).
+// If replay, it starts over when all documents were replayed.
+// Errors opening or reading the file are fatal.
+func NewFileDocGenerator(path string, format string, replay bool) *FileDocGenerator {
+	if format == "" {
+		format = DatasetFormat(path)
+	}
+	if format != "bson" && format != "json" {
+		log.Fatal("invalid dataset format ", format, ", must be \"bson\" or \"json\"")
+	}
+	g := &FileDocGenerator{path: path, format: format, replay: replay}
+	g.open()
+	return g
+}
+
+// opens the file, to replay it from the start
+func (g *FileDocGenerator) open() {
+	if g.file != nil {
+		g.file.Close()
+	}
+	f, err := os.Open(g.path)
+	if err != nil {
+		log.Fatal("Error opening dataset ", g.path, ": ", err)
+	}
+	g.file = f
+	g.reader = bufio.NewReaderSize(f, 1<<20)
+	g.dec = json.NewDecoder(g.reader)
+	g.dec.UseNumber()
+}
+
+// reads the next document, returning io.EOF if there are no more
+func (g *FileDocGenerator) next() (interface{}, error) {
+	if g.format == "json" {
+		v, err := readJSONValue(g.dec)
+		if err != nil {
+			return nil, err
+		}
+		doc, ok := v.(bson.D)
+		if !ok {
+			return nil, errors.New("a line of the dataset is not a document")
+		}
+		return doc, nil
+	}
+	var size int32
+	if err := binary.Read(g.reader, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 5 {
+		return nil, errors.New("invalid document size")
+	}
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data, uint32(size))
+	if _, err := io.ReadFull(g.reader, data[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// returns the next document of the dataset
+func (g *FileDocGenerator) Generate() interface{} {
+	doc, err := g.next()
+	if err == io.EOF {
+		if g.numDocs == 0 {
+			log.Fatal("dataset ", g.path, " is empty")
+		}
+		if !g.replay {
+			log.Fatal("dataset ", g.path, " has only ", g.numDocs, " documents, fewer than the load; use -datasetReplay to replay them from the first, for documents without _id")
+		}
+		log.Println("replayed all documents of ", g.path, ", starting over")
+		g.open()
+		doc, err = g.next()
+	}
+	if err != nil {
+		log.Fatal("Error reading dataset ", g.path, ": ", err)
+	}
+	g.numDocs++
+	return doc
+}
+
+// closes the file
+func (g *FileDocGenerator) Close() {
+	g.file.Close()
+}
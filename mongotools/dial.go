@@ -0,0 +1,244 @@
+package mongotools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// command line variables for connecting to the server
+var (
+	uri            = flag.String("uri", "", "MongoDB connection string, mongodb://[username[:password]@]host1[:port1][,host2[:port2],...][/[authDB]][?options]. If set, -host is ignored. Flags given on the command line override the options of the URI")
+	replicaSet     = flag.String("replicaSet", "", "name of the replica set to connect to. If set, connecting fails if the servers are not members of it")
+	authDB         = flag.String("authDB", "", "database to authenticate against. Defaults to the database of -uri, or \"admin\"")
+	authMechanism  = flag.String("authMechanism", "", "authentication mechanism: \"MONGO-CR\" (MongoDB challenge-response, the default), \"PLAIN\" (LDAP) or \"GSSAPI\" (Kerberos, only if built with -tags sasl). SCRAM-SHA-1 and SCRAM-SHA-256, the defaults of MongoDB 3.0 and later, are not supported by mgo, so servers that require them cannot be used")
+	username       = flag.String("username", "", "user to authenticate as. If empty, no authentication is done")
+	passwordEnv    = flag.String("passwordEnv", "", "name of the environment variable holding the password of -username")
+	passwordFile   = flag.String("passwordFile", "", "file holding the password of -username")
+	useTLS         = flag.Bool("tls", false, "whether to connect with TLS")
+	tlsCAFile      = flag.String("tlsCAFile", "", "with -tls, PEM file of the certificate authorities to verify the server's certificate with. Defaults to the system's")
+	tlsCertFile    = flag.String("tlsCertFile", "", "with -tls, PEM file holding the client's certificate and its key, for servers that require them")
+	tlsInsecure    = flag.Bool("tlsInsecure", false, "with -tls, do not verify the server's certificate")
+	connectTimeout = flag.Duration("connectTimeout", 10*time.Second, "how long to wait for the servers when connecting")
+)
+
+// the options of a connection string that Dial understands, and the
+// flags they set unless those are given on the command line
+var uriOptionFlags = map[string]string{
+	"replicaSet":            "replicaSet",
+	"authSource":            "authDB",
+	"authMechanism":         "authMechanism",
+	"ssl":                   "tls",
+	"tls":                   "tls",
+	"tlsCAFile":             "tlsCAFile",
+	"tlsCertificateKeyFile": "tlsCertFile",
+	"tlsInsecure":           "tlsInsecure",
+	"w":                     "w",
+	"journal":               "j",
+	"fsync":                 "fsync",
+	"readPreference":        "readPreference",
+}
+
+// options of a connection string whose value is in milliseconds, and the duration flags they set
+var uriMillisOptionFlags = map[string]string{
+	"connectTimeoutMS":         "connectTimeout",
+	"socketTimeoutMS":          "socketTimeout",
+	"serverSelectionTimeoutMS": "syncTimeout",
+	"wtimeoutMS":               "wtimeout",
+}
+
+// parses a connection string into the addresses of the servers, the
+// credentials, and the database. Its options set the flags in uriOptionFlags
+// and uriMillisOptionFlags, unless they were given on the command line
+func parseURI(s string) (info mgo.DialInfo) {
+	rest := strings.TrimPrefix(s, "mongodb://")
+	var query string
+	if i := strings.Index(rest, "?"); i >= 0 {
+		rest, query = rest[:i], rest[i+1:]
+	}
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, info.Database = rest[:i], rest[i+1:]
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		var userinfo string
+		userinfo, rest = rest[:i], rest[i+1:]
+		var err error
+		if i = strings.Index(userinfo, ":"); i >= 0 {
+			if info.Password, err = url.QueryUnescape(userinfo[i+1:]); err != nil {
+				log.Fatal("invalid password in -uri: ", err)
+			}
+			userinfo = userinfo[:i]
+		}
+		if info.Username, err = url.QueryUnescape(userinfo); err != nil {
+			log.Fatal("invalid username in -uri: ", err)
+		}
+	}
+	if rest == "" {
+		log.Fatal("no hosts in -uri")
+	}
+	info.Addrs = strings.Split(rest, ",")
+
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		log.Fatal("invalid options in -uri: ", err)
+	}
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	for name, values := range options {
+		value := values[len(values)-1]
+		var flagName string
+		if f, ok := uriOptionFlags[name]; ok {
+			flagName = f
+		} else if f, ok := uriMillisOptionFlags[name]; ok {
+			flagName = f
+			ms, err := strconv.Atoi(value)
+			if err != nil {
+				log.Fatal("invalid value for ", name, " in -uri: ", value)
+			}
+			value = (time.Duration(ms) * time.Millisecond).String()
+		} else if name == "maxPoolSize" {
+			log.Println("mgo does not limit the size of its connection pool, ignoring maxPoolSize in -uri")
+			continue
+		} else {
+			log.Fatal("unsupported option in -uri: ", name)
+		}
+		if setOnCommandLine[flagName] {
+			continue
+		}
+		if err := flag.Set(flagName, value); err != nil {
+			log.Fatal("invalid value for ", name, " in -uri: ", value)
+		}
+	}
+	return info
+}
+
+// returns mechanism, an authentication mechanism from -authMechanism or the connection string,
+// as mgo names it, logging a fatal error if mgo does not support it. mgo sends every mechanism
+// it does not know to SASL, which fails unless it is built with -tags sasl, and supports only
+// the mechanisms of the SASL library there, not SCRAM
+func checkAuthMechanism(mechanism string) string {
+	switch strings.ToUpper(mechanism) {
+	case "":
+		return ""
+	case "MONGO-CR", "MONGODB-CR":
+		return "MONGO-CR"
+	case "PLAIN":
+		return "PLAIN"
+	case "GSSAPI":
+		return "GSSAPI"
+	case "SCRAM-SHA-1", "SCRAM-SHA-256":
+		log.Fatal("authentication mechanism ", mechanism, " is not supported by mgo, the server must allow MONGODB-CR")
+	}
+	log.Fatal("unsupported authentication mechanism ", mechanism, ", must be MONGO-CR, PLAIN or GSSAPI")
+	return ""
+}
+
+// returns the password of -username, read from -passwordEnv or -passwordFile
+func passwordFromFlags() string {
+	if *passwordEnv != "" && *passwordFile != "" {
+		log.Fatal("at most one of -passwordEnv and -passwordFile may be set")
+	}
+	if *passwordEnv != "" {
+		password, ok := os.LookupEnv(*passwordEnv)
+		if !ok {
+			log.Fatal("environment variable ", *passwordEnv, " given by -passwordEnv is not set")
+		}
+		return password
+	}
+	if *passwordFile != "" {
+		data, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			log.Fatal("Error reading -passwordFile: ", err)
+		}
+		return strings.TrimRight(string(data), "\r\n")
+	}
+	return ""
+}
+
+// returns the TLS configuration defined by the tls flags
+func tlsConfigFromFlags() *tls.Config {
+	config := &tls.Config{InsecureSkipVerify: *tlsInsecure}
+	if *tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(*tlsCAFile)
+		if err != nil {
+			log.Fatal("Error reading -tlsCAFile: ", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatal("no certificates found in ", *tlsCAFile)
+		}
+	}
+	if *tlsCertFile != "" {
+		// the file holds both the certificate and its key
+		cert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsCertFile)
+		if err != nil {
+			log.Fatal("Error loading -tlsCertFile: ", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// Dial connects to the servers given by the uri flag, or if it is not set, by host
+// (a host:port string, a comma separated list of them, or a connection string),
+// with the credentials, TLS configuration and replica set given on the command line.
+// It then sets the write concern, read preference and timeouts of the session with
+// ApplySessionOptions. Any error is fatal. Every benchmark connects with Dial, and
+// those that run benchmark.Run then call MonitorServerStatus.
+//
+// Example:
+//
+//     session := mongotools.Dial(*host)
+//     defer session.Close()
+func Dial(host string) *mgo.Session {
+	source := host
+	if *uri != "" {
+		source = *uri
+	}
+	info := parseURI(source)
+	info.Timeout = *connectTimeout
+	if *username != "" {
+		info.Username = *username
+		info.Password = ""
+	}
+	if password := passwordFromFlags(); password != "" {
+		info.Password = password
+	}
+	if info.Username == "" && info.Password != "" {
+		log.Fatal("a password was given without a username")
+	}
+	if *authDB != "" {
+		info.Source = *authDB
+	}
+	info.Mechanism = checkAuthMechanism(*authMechanism)
+	if *useTLS {
+		config := tlsConfigFromFlags()
+		info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: *connectTimeout}
+			return tls.DialWithDialer(dialer, "tcp", addr.String(), config)
+		}
+	}
+	session, err := mgo.DialWithInfo(&info)
+	if err != nil {
+		log.Fatal("Error connecting to ", strings.Join(info.Addrs, ","), ": ", err)
+	}
+	if *replicaSet != "" {
+		// mgo does not check the name of the replica set itself
+		if name := mustGetServerInfo(session).ReplicaSet; name != *replicaSet {
+			log.Fatal("expected to connect to replica set ", *replicaSet, ", but the servers are members of \"", name, "\"")
+		}
+	}
+	ApplySessionOptions(session)
+	return session
+}
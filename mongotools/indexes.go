@@ -0,0 +1,318 @@
+package mongotools
+
+import (
+	"flag"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"strings"
+)
+
+// command line variables for verifying the indexes of existing collections
+var (
+	doVerifyIndexes     = flag.Bool("verifyIndexes", false, "when using existing collections (-create is false), verify that they have the indexes the benchmark expects, and on TokuMX, that their indexes have the -compression, -nodeSize and -basementSize given")
+	buildMissingIndexes = flag.Bool("buildMissingIndexes", false, "with -verifyIndexes, build the expected indexes that are missing instead of failing")
+)
+
+// Describes an index of a benchmark collection, including the options
+// TokuMX supports per index. The TokuMX options that are left as zero values
+// are those of the collection (defined by the compression, nodeSize and basementSize flags).
+//
+// Example, for a clustering index compressed with quicklz:
+//
+//     spec := mongotools.IndexSpec{Index: mgo.Index{Key: []string{"cid"}}, Clustering: true, Compression: "quicklz"}
+type IndexSpec struct {
+	mgo.Index
+	// Whether the index is clustering, meaning it stores a full copy of each document (TokuMX only)
+	Clustering bool
+	// The compression of the index: "zlib", "lzma", "quicklz" or "none"
+	Compression string
+	// The node size (pageSize) of the index
+	NodeSize int
+	// The basement node size (readPageSize) of the index
+	BasementSize int
+}
+
+// returns IndexSpecs for plain indexes, which use the options of the collection
+func IndexSpecs(indexes ...mgo.Index) []IndexSpec {
+	specs := make([]IndexSpec, len(indexes))
+	for i := range indexes {
+		specs[i].Index = indexes[i]
+	}
+	return specs
+}
+
+// returns true if the index has TokuMX options that differ from those of the collection
+func (spec IndexSpec) hasTokuOptions() bool {
+	return spec.Compression != "" || spec.NodeSize != 0 || spec.BasementSize != 0
+}
+
+// returns the TokuMX options of the index, given the options of its collection
+func (spec IndexSpec) tokuOptions(collOptions tokuMXCreateOptions) tokuMXCreateOptions {
+	ret := collOptions
+	if spec.Compression != "" {
+		ret.CompressionType = spec.Compression
+	}
+	if spec.NodeSize != 0 {
+		ret.NodeSize = spec.NodeSize
+	}
+	if spec.BasementSize != 0 {
+		ret.BasementSize = spec.BasementSize
+	}
+	return ret
+}
+
+// the definition of an index, as stored by the server
+type indexInfo struct {
+	Name         string "name"
+	NS           string "ns,omitempty"
+	Key          bson.D "key"
+	Unique       bool   "unique,omitempty"
+	Sparse       bool   "sparse,omitempty"
+	Clustering   bool   "clustering,omitempty"
+	Compression  string "compression,omitempty"
+	NodeSize     int    "pageSize,omitempty"
+	BasementSize int    "readPageSize,omitempty"
+}
+
+// converts an index key in the format of mgo.Index.Key (e.g. []string{"pr", "-ts"},
+// or []string{"$hashed:_id"}) into the key document the server uses, and returns
+// the default name of such an index
+func indexKey(key []string) (name string, realKey bson.D) {
+	for _, field := range key {
+		var order interface{} = 1
+		raw := field
+		if strings.HasPrefix(field, "$") {
+			c := strings.Index(field, ":")
+			if c < 2 || c == len(field)-1 {
+				log.Fatal("invalid index key ", raw)
+			}
+			order = field[1:c]
+			field = field[c+1:]
+		} else if strings.HasPrefix(field, "-") {
+			order = -1
+			field = field[1:]
+		} else if strings.HasPrefix(field, "+") {
+			field = field[1:]
+		}
+		if field == "" {
+			log.Fatal("invalid index key ", raw)
+		}
+		if name != "" {
+			name += "_"
+		}
+		name += field + "_" + bsonString(order)
+		realKey = append(realKey, bson.DocElem{Name: field, Value: order})
+	}
+	if name == "" {
+		log.Fatal("invalid index key: no fields provided")
+	}
+	return name, realKey
+}
+
+func bsonString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case int:
+		if x < 0 {
+			return "-1"
+		}
+		return "1"
+	}
+	return ""
+}
+
+// returns the direction of a key element as a float64, or 0 if it is not a number
+func keyDirection(v interface{}) float64 {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int32:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case float64:
+		return x
+	}
+	return 0
+}
+
+// returns true if the key documents a and b define the same index key.
+// Servers may store directions as ints or floats, so they are compared as numbers
+func keysEqual(a bson.D, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+		as, aIsString := a[i].Value.(string)
+		bs, bIsString := b[i].Value.(string)
+		if aIsString || bIsString {
+			if as != bs {
+				return false
+			}
+		} else if (keyDirection(a[i].Value) < 0) != (keyDirection(b[i].Value) < 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns the definitions of the indexes of a collection, with the listIndexes
+// command if the server has it, otherwise by querying db.system.indexes
+func readIndexes(db *mgo.Database, collname string) []indexInfo {
+	var indexes []indexInfo
+	if mustGetServerInfo(db.Session).hasListCommands() {
+		var result cursorResult
+		if err := db.Run(bson.D{{"listIndexes", collname}}, &result); err != nil {
+			log.Fatal("Received error ", err, " when reading the indexes of ", db.Name, ".", collname)
+		}
+		indexes = make([]indexInfo, len(result.Cursor.FirstBatch))
+		for i := range indexes {
+			if err := result.Cursor.FirstBatch[i].Unmarshal(&indexes[i]); err != nil {
+				log.Fatal("Received error ", err, " when reading the indexes of ", db.Name, ".", collname)
+			}
+		}
+		return indexes
+	}
+	err := db.C("system.indexes").Find(bson.M{"ns": db.C(collname).FullName}).All(&indexes)
+	if err != nil {
+		log.Fatal("Received error ", err, " when reading the indexes of ", db.Name, ".", collname)
+	}
+	return indexes
+}
+
+// creates an index described by spec on a collection. mgo's EnsureIndex inserts
+// the definition of the index into system.indexes, which servers with the
+// listIndexes command no longer allow, so for them the createIndexes command
+// is used. EnsureIndex also knows nothing of clustering indexes, so on TokuMX
+// they are inserted into system.indexes here.
+// The TokuMX options of the index are set afterwards, by applyIndexSpecOptions
+func createIndex(db *mgo.Database, collname string, spec IndexSpec, isToku bool) {
+	if spec.Clustering && !isToku {
+		log.Println("MongoDB does not support clustering indexes, creating index ", spec.Key, " as a regular index")
+	}
+	var err error
+	if !isToku && mustGetServerInfo(db.Session).hasListCommands() {
+		name, key := indexKey(spec.Key)
+		info := indexInfo{
+			Name:   name,
+			Key:    key,
+			Unique: spec.Unique,
+			Sparse: spec.Sparse}
+		var result bson.M
+		err = db.Run(bson.D{{"createIndexes", collname}, {"indexes", []indexInfo{info}}}, &result)
+	} else if spec.Clustering && isToku {
+		name, key := indexKey(spec.Key)
+		info := indexInfo{
+			Name:       name,
+			NS:         db.C(collname).FullName,
+			Key:        key,
+			Unique:     spec.Unique,
+			Sparse:     spec.Sparse,
+			Clustering: true}
+		err = db.C("system.indexes").Insert(&info)
+	} else {
+		err = db.C(collname).EnsureIndex(spec.Index)
+	}
+	if err != nil {
+		log.Fatal("Received error ", err, " when adding index ", spec)
+	}
+}
+
+// on TokuMX, sets the options of the index described by spec, if they differ from
+// collOptions, the options of the collection
+func applyIndexSpecOptions(db *mgo.Database, collname string, spec IndexSpec, collOptions tokuMXCreateOptions) {
+	if spec.hasTokuOptions() {
+		name, _ := indexKey(spec.Key)
+		applyTokuIndexOptions(db, collname, name, spec.tokuOptions(collOptions))
+	}
+}
+
+// returns the problems with the TokuMX options of an existing index, if they differ from options
+func tokuIndexOptionProblems(collname string, index indexInfo, options tokuMXCreateOptions) []string {
+	var problems []string
+	if index.Compression != "" && index.Compression != options.CompressionType {
+		problems = append(problems, collname+" index "+index.Name+" has compression "+index.Compression+", expected "+options.CompressionType)
+	}
+	if index.NodeSize != 0 && index.NodeSize != options.NodeSize {
+		problems = append(problems, collname+" index "+index.Name+" has a different nodeSize (pageSize) than -nodeSize")
+	}
+	if index.BasementSize != 0 && index.BasementSize != options.BasementSize {
+		problems = append(problems, collname+" index "+index.Name+" has a different basementSize (readPageSize) than -basementSize")
+	}
+	return problems
+}
+
+// Verifies that an existing collection has every index in indexes, with the same
+// key, uniqueness and sparseness, and on TokuMX, that it is clustered on
+// tokuOptions.PrimaryKey (if set) and that all its indexes have the options in tokuOptions.
+// Indexes that are missing are built if -buildMissingIndexes is set. All other
+// differences are logged, and are fatal, as fixing them requires rebuilding the collection.
+func verifyIndexes(s *mgo.Session, dbname string, collname string, tokuOptions tokuMXCreateOptions, indexes []IndexSpec) {
+	db := s.DB(dbname)
+	isToku := IsTokuMX(db)
+	existing := readIndexes(db, collname)
+	// the options each existing index is expected to have, by name
+	expectedOptions := make(map[string]tokuMXCreateOptions)
+	var problems []string
+	for _, expected := range indexes {
+		name, key := indexKey(expected.Key)
+		found := false
+		for _, index := range existing {
+			if !keysEqual(key, index.Key) {
+				continue
+			}
+			found = true
+			expectedOptions[index.Name] = expected.tokuOptions(tokuOptions)
+			if index.Unique != expected.Unique {
+				problems = append(problems, collname+" index "+index.Name+" does not have the expected uniqueness")
+			}
+			if index.Sparse != expected.Sparse {
+				problems = append(problems, collname+" index "+index.Name+" does not have the expected sparseness")
+			}
+			if isToku && index.Clustering != expected.Clustering {
+				problems = append(problems, collname+" index "+index.Name+" does not have the expected clustering")
+			}
+		}
+		if found {
+			continue
+		}
+		if !*buildMissingIndexes {
+			problems = append(problems, collname+" is missing index "+name+", run with -buildMissingIndexes to build it")
+			continue
+		}
+		log.Println("building missing index ", name, " on ", dbname, ".", collname)
+		createIndex(db, collname, expected, isToku)
+		if isToku {
+			applyTokuIndexOptions(db, collname, name, expected.tokuOptions(tokuOptions))
+		}
+	}
+	if isToku && tokuOptions.PrimaryKey != nil {
+		found := false
+		for _, index := range existing {
+			found = found || keysEqual(tokuOptions.PrimaryKey, index.Key)
+		}
+		if !found {
+			problems = append(problems, collname+" is not clustered on the expected primary key")
+		}
+	}
+	if isToku {
+		for _, index := range existing {
+			options, ok := expectedOptions[index.Name]
+			if !ok {
+				options = tokuOptions
+			}
+			problems = append(problems, tokuIndexOptionProblems(collname, index, options)...)
+		}
+	}
+	for _, problem := range problems {
+		log.Println(problem)
+	}
+	if len(problems) > 0 {
+		log.Fatal("Collection ", dbname, ".", collname, " does not match the indexes expected by the benchmark")
+	}
+}
@@ -0,0 +1,158 @@
+package mongotools
+
+import (
+	"flag"
+	"io"
+	"labix.org/v2/mgo"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// command line variables for retrying operations that fail with transient errors
+var (
+	retryMaxAttempts = flag.Int("retryMaxAttempts", 1, "max number of attempts for an operation that fails with a transient error (lock not granted, socket errors). 1 means no retries")
+	retryBackoff     = flag.Duration("retryBackoff", 10*time.Millisecond, "time to wait before the first retry, doubled on each following retry")
+	retryMaxBackoff  = flag.Duration("retryMaxBackoff", time.Second, "max time to wait between retries")
+	retryJitter      = flag.Float64("retryJitter", 0.5, "fraction of the backoff that is randomized, between 0 and 1")
+)
+
+// A RetryPolicy defines how an operation that failed with a retryable error
+// is retried. The zero value runs the operation once and never retries.
+//
+// Example:
+//
+//     policy := mongotools.DefaultRetryPolicy()
+//     retries, err := policy.Do(func() error {
+//         return coll.Insert(doc)
+//     })
+type RetryPolicy struct {
+	// The maximum number of times the operation is run, including the first attempt.
+	// Values <= 1 mean the operation is never retried.
+	MaxAttempts int
+	// The time to wait before the first retry. It is doubled on each following retry.
+	InitialBackoff time.Duration
+	// The maximum time to wait between two attempts. 0 means there is no maximum.
+	MaxBackoff time.Duration
+	// The fraction of the backoff that is randomized, so that threads that failed together
+	// do not retry together. 0 means no jitter, 1 means the wait is anywhere between 0 and twice the backoff.
+	Jitter float64
+	// Decides whether an error is worth retrying. If nil, IsTransientError is used.
+	Retryable func(error) bool
+	// If not nil, called with the error before each retry. Works use this to
+	// reset state that the error invalidated, for instance by refreshing their session.
+	OnRetry func(error)
+}
+
+// returns the RetryPolicy defined by the command line flags
+// "retryMaxAttempts", "retryBackoff", "retryMaxBackoff" and "retryJitter",
+// retrying errors for which IsTransientError is true.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    *retryMaxAttempts,
+		InitialBackoff: *retryBackoff,
+		MaxBackoff:     *retryMaxBackoff,
+		Jitter:         *retryJitter}
+}
+
+// returns true if err is an error that may go away if the operation is run again.
+// This includes TokuMX lock conflicts and errors on the socket to the server.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return IsLockConflict(err) || IsSocketError(err)
+}
+
+// returns true if err is an error on the socket to the server, after which the
+// session must be refreshed before it is used again. What the operation did on
+// the server is then unknown, and on TokuMX, the transaction of the connection is gone.
+func IsSocketError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// the errors of mgo's Bulk are wrapped, so only their message is left
+	msg := err.Error()
+	return msg == io.EOF.Error() || msg == io.ErrUnexpectedEOF.Error() ||
+		strings.Contains(msg, "no reachable servers") || strings.Contains(msg, "Closed explicitly") ||
+		strings.Contains(msg, "i/o timeout") || strings.Contains(msg, "connection reset") || strings.Contains(msg, "broken pipe")
+}
+
+// error codes of MongoDB for conflicts between transactions
+const (
+	writeConflictCode     = 112
+	noSuchTransactionCode = 251 // the server aborted the transaction, for instance after a conflict
+)
+
+// returns true if err is TokuMX reporting that a document lock could not be
+// acquired, or MongoDB reporting a write conflict between transactions,
+// which means the operation (or its transaction) must be restarted.
+func IsLockConflict(err error) bool {
+	var msg string
+	switch e := err.(type) {
+	case *mgo.LastError:
+		msg = e.Err
+	case *mgo.QueryError:
+		if e.Code == writeConflictCode || e.Code == noSuchTransactionCode {
+			return true
+		}
+		msg = e.Message
+	case nil:
+		return false
+	default:
+		// mgo's Bulk returns the errors of the server wrapped, with their message
+		msg = e.Error()
+	}
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "lock not granted") || strings.Contains(msg, "deadlock") || strings.Contains(msg, "writeconflict")
+}
+
+// returns true if err should be retried under this policy
+func (p RetryPolicy) IsRetryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsTransientError(err)
+}
+
+// returns how long to wait before retry number retry (indexed from 1)
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(p.Jitter * (2*rand.Float64() - 1) * float64(d))
+	}
+	return d
+}
+
+// Do runs f until it succeeds, returns an error that is not retryable,
+// or has been run p.MaxAttempts times. It returns the number of retries
+// that were done, so that Works may report them separately from errors,
+// and the error of the last attempt.
+func (p RetryPolicy) Do(f func() error) (retries int, err error) {
+	for {
+		err = f()
+		if err == nil || retries+1 >= p.MaxAttempts || !p.IsRetryable(err) {
+			return retries, err
+		}
+		retries++
+		if p.OnRetry != nil {
+			p.OnRetry(err)
+		}
+		if d := p.backoff(retries); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
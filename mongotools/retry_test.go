@@ -0,0 +1,139 @@
+package mongotools
+
+import (
+	"errors"
+	"io"
+	"labix.org/v2/mgo"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		policy RetryPolicy
+		retry  int
+		want   time.Duration
+	}{
+		{RetryPolicy{}, 1, 0},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond}, 1, 10 * time.Millisecond},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond}, 2, 20 * time.Millisecond},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond}, 4, 80 * time.Millisecond},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 3, 40 * time.Millisecond},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 4, 50 * time.Millisecond},
+		{RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}, 1000, 50 * time.Millisecond},
+		{RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 100 * time.Millisecond}, 1, 100 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := test.policy.backoff(test.retry); got != test.want {
+			t.Errorf("%+v: backoff(%d) = %v, want %v", test.policy, test.retry, got, test.want)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	for _, jitter := range []float64{0.1, 0.5, 1} {
+		p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond, Jitter: jitter}
+		for _, retry := range []int{1, 3, 10} {
+			d := p.InitialBackoff << uint(retry-1)
+			if d > p.MaxBackoff {
+				d = p.MaxBackoff
+			}
+			min := time.Duration((1 - jitter) * float64(d))
+			max := time.Duration((1 + jitter) * float64(d))
+			varied := false
+			for i := 0; i < 1000; i++ {
+				got := p.backoff(retry)
+				if got < min || got > max {
+					t.Fatalf("jitter %g: backoff(%d) = %v, not in [%v, %v]", jitter, retry, got, min, max)
+				}
+				varied = varied || got != d
+			}
+			if !varied {
+				t.Errorf("jitter %g: backoff(%d) is always %v", jitter, retry, d)
+			}
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	transient := io.EOF
+	permanent := errors.New("permanent")
+	tests := []struct {
+		maxAttempts int
+		errs        []error // the errors of the successive attempts, nil after the last
+		wantCalls   int
+		wantRetries int
+		wantErr     error
+	}{
+		{0, []error{transient}, 1, 0, transient},
+		{1, []error{transient}, 1, 0, transient},
+		{3, []error{transient, transient, transient, transient}, 3, 2, transient},
+		{3, []error{transient}, 2, 1, nil},
+		{3, []error{permanent}, 1, 0, permanent},
+		{3, []error{transient, permanent}, 2, 1, permanent},
+		{3, nil, 1, 0, nil},
+	}
+	for _, test := range tests {
+		calls, onRetries := 0, 0
+		p := RetryPolicy{MaxAttempts: test.maxAttempts, OnRetry: func(error) { onRetries++ }}
+		retries, err := p.Do(func() error {
+			calls++
+			if calls <= len(test.errs) {
+				return test.errs[calls-1]
+			}
+			return nil
+		})
+		if calls != test.wantCalls || retries != test.wantRetries || err != test.wantErr || onRetries != retries {
+			t.Errorf("MaxAttempts %d, errors %v: %d calls, %d retries, %d OnRetry, error %v; want %d calls, %d retries, error %v",
+				test.maxAttempts, test.errs, calls, retries, onRetries, err, test.wantCalls, test.wantRetries, test.wantErr)
+		}
+	}
+}
+
+// an error that only has a message, as mgo's Bulk returns the errors of the server
+type messageError string
+
+func (e messageError) Error() string {
+	return string(e)
+}
+
+func TestErrorClassifiers(t *testing.T) {
+	tests := []struct {
+		err          error
+		socket       bool
+		lockConflict bool
+	}{
+		{nil, false, false},
+		{errors.New("E11000 duplicate key error"), false, false},
+		{io.EOF, true, false},
+		{io.ErrUnexpectedEOF, true, false},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection refused")}, true, false},
+		{errors.New("no reachable servers"), true, false},
+		{errors.New("Closed explicitly"), true, false},
+		{messageError("EOF"), true, false},
+		{messageError("unexpected EOF"), true, false},
+		{messageError("read tcp 127.0.0.1:27017: i/o timeout"), true, false},
+		{messageError("read tcp 127.0.0.1:27017: connection reset by peer"), true, false},
+		{messageError("write tcp 127.0.0.1:27017: broken pipe"), true, false},
+		{messageError("EOF in the middle of a document"), false, false},
+		{&mgo.LastError{Err: "Lock not granted. Try restarting the transaction."}, false, true},
+		{&mgo.LastError{Err: "deadlock detected"}, false, true},
+		{&mgo.LastError{Err: "E11000 duplicate key error"}, false, false},
+		{&mgo.QueryError{Code: writeConflictCode, Message: "WriteConflict"}, false, true},
+		{&mgo.QueryError{Code: noSuchTransactionCode, Message: "Transaction 3 has been aborted"}, false, true},
+		{&mgo.QueryError{Code: 2, Message: "bad value"}, false, false},
+		{messageError("lock not granted"), false, true},
+	}
+	for _, test := range tests {
+		if got := IsSocketError(test.err); got != test.socket {
+			t.Errorf("IsSocketError(%v) = %v", test.err, got)
+		}
+		if got := IsLockConflict(test.err); got != test.lockConflict {
+			t.Errorf("IsLockConflict(%v) = %v", test.err, got)
+		}
+		if got := IsTransientError(test.err); got != (test.socket || test.lockConflict) {
+			t.Errorf("IsTransientError(%v) = %v", test.err, got)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package mongotools
+
+import (
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"sync"
+)
+
+// ServerInfo describes the server, or cluster, a session is connected to:
+// what it is and what it supports. Use GetServerInfo to obtain it, which asks the
+// server only once and caches the result, so that checking the server (for instance,
+// whether it is TokuMX on every Transaction.Begin) adds no round trips to the workload.
+type ServerInfo struct {
+	Version       string // the MongoDB version, which for TokuMX is the version TokuMX is based on
+	VersionArray  []int
+	TokuMXVersion string // "" if the server is not TokuMX
+	StorageEngine string // e.g. "wiredTiger" or "mmapv1", and "tokuft" for TokuMX
+	ReplicaSet    string // the name of the replica set the server is a member of, "" if none
+	IsPrimary     bool
+	IsSecondary   bool
+	IsMongos      bool            // true if connected to the router of a sharded cluster
+	Commands      map[string]bool // the commands the server supports, as listed by listCommands
+}
+
+var (
+	serverInfoMutex sync.Mutex
+	// the ServerInfos obtained so far, one per deployment (server, replica set or cluster)
+	serverInfos []*cachedServerInfo
+)
+
+// a cached ServerInfo, with the servers of the deployment it describes that sessions were connected to
+type cachedServerInfo struct {
+	servers map[string]bool
+	info    *ServerInfo
+}
+
+// returns the cached ServerInfo of the deployment servers are members of, nil if there is none
+func lookupServerInfo(servers []string) *ServerInfo {
+	serverInfoMutex.Lock()
+	defer serverInfoMutex.Unlock()
+	for _, cached := range serverInfos {
+		for _, server := range servers {
+			if cached.servers[server] {
+				// members that join later, or come back, are members of the same deployment
+				for _, server := range servers {
+					cached.servers[server] = true
+				}
+				return cached.info
+			}
+		}
+	}
+	return nil
+}
+
+// GetServerInfo returns the ServerInfo of the server s is connected to. The first call
+// for a deployment queries it, further calls, even with copies of s, return the cached result.
+// A deployment is recognized by any of its servers, so that members of a replica set going
+// away and coming back do not make it be queried again. It is queried without holding
+// any lock, and only if the query succeeds is the result cached.
+func GetServerInfo(s *mgo.Session) (*ServerInfo, error) {
+	servers := s.LiveServers()
+	if info := lookupServerInfo(servers); info != nil {
+		return info, nil
+	}
+	info, err := newServerInfo(s)
+	if err != nil {
+		return nil, err
+	}
+	if cached := lookupServerInfo(servers); cached != nil {
+		// another thread queried it meanwhile
+		return cached, nil
+	}
+	cached := &cachedServerInfo{servers: make(map[string]bool), info: info}
+	for _, server := range servers {
+		cached.servers[server] = true
+	}
+	serverInfoMutex.Lock()
+	serverInfos = append(serverInfos, cached)
+	serverInfoMutex.Unlock()
+	return info, nil
+}
+
+// returns the ServerInfo of the server s is connected to, for setting up a
+// benchmark, at which point failing to get it is fatal
+func mustGetServerInfo(s *mgo.Session) *ServerInfo {
+	info, err := GetServerInfo(s)
+	if err != nil {
+		log.Fatal("Received error ", err, " when getting the information of the server, exiting")
+	}
+	return info
+}
+
+// queries the server s is connected to for its ServerInfo
+func newServerInfo(s *mgo.Session) (*ServerInfo, error) {
+	info := &ServerInfo{Commands: make(map[string]bool)}
+	var buildInfo struct {
+		Version       string "version"
+		VersionArray  []int  "versionArray"
+		TokuMXVersion string "tokumxVersion"
+	}
+	if err := s.Run("buildInfo", &buildInfo); err != nil {
+		return nil, err
+	}
+	info.Version = buildInfo.Version
+	info.VersionArray = buildInfo.VersionArray
+	info.TokuMXVersion = buildInfo.TokuMXVersion
+
+	var isMaster struct {
+		SetName   string "setName"
+		IsMaster  bool   "ismaster"
+		Secondary bool   "secondary"
+		Msg       string "msg"
+	}
+	if err := s.Run("isMaster", &isMaster); err != nil {
+		return nil, err
+	}
+	info.ReplicaSet = isMaster.SetName
+	info.IsPrimary = isMaster.IsMaster
+	info.IsSecondary = isMaster.Secondary
+	info.IsMongos = isMaster.Msg == "isdbgrid"
+
+	var status struct {
+		StorageEngine struct {
+			Name string "name"
+		} "storageEngine"
+	}
+	if err := s.Run("serverStatus", &status); err != nil {
+		// serverStatus needs more privileges than the other commands
+		log.Println("could not get the status of the server: ", err)
+	}
+	switch {
+	case info.IsTokuMX():
+		info.StorageEngine = "tokuft"
+	case status.StorageEngine.Name != "":
+		info.StorageEngine = status.StorageEngine.Name
+	default:
+		// the only storage engine before MongoDB 3.0
+		info.StorageEngine = "mmapv1"
+	}
+
+	var commands struct {
+		Commands bson.M "commands"
+	}
+	if err := s.Run("listCommands", &commands); err != nil {
+		log.Println("could not list the commands of the server: ", err)
+	}
+	for name := range commands.Commands {
+		info.Commands[name] = true
+	}
+	return info, nil
+}
+
+// IsTokuMX returns true if the server is TokuMX
+func (info *ServerInfo) IsTokuMX() bool {
+	return info.TokuMXVersion != ""
+}
+
+// VersionAtLeast returns true if the MongoDB version of the server is greater than
+// or equal to version, given as major, minor, and so on. For example,
+// VersionAtLeast(2, 6) is true for version 3.0.4
+func (info *ServerInfo) VersionAtLeast(version ...int) bool {
+	for i := range version {
+		curr := 0
+		if i < len(info.VersionArray) {
+			curr = info.VersionArray[i]
+		}
+		if curr != version[i] {
+			return curr > version[i]
+		}
+	}
+	return true
+}
+
+// HasCommand returns true if the server supports the named command
+func (info *ServerInfo) HasCommand(name string) bool {
+	return info.Commands[name]
+}
+
+// returns true if the server has the listCollections, listIndexes and createIndexes
+// commands, which must be used instead of the system.namespaces and system.indexes
+// collections since MongoDB 3.0, as newer storage engines do not have them.
+// TokuMX and older versions of MongoDB only have the collections.
+func (info *ServerInfo) hasListCommands() bool {
+	return !info.IsTokuMX() && info.VersionAtLeast(3, 0)
+}
+
+// returns true if the server supports multi-document transactions on sessions,
+// which MongoDB has for replica sets since 4.0, and for sharded clusters since 4.2
+func (info *ServerInfo) hasSessionTransactions() bool {
+	if info.IsTokuMX() {
+		return false
+	}
+	return (info.ReplicaSet != "" && info.VersionAtLeast(4, 0)) || (info.IsMongos && info.VersionAtLeast(4, 2))
+}
+
+// String describes the server, for logging
+func (info *ServerInfo) String() string {
+	desc := "MongoDB " + info.Version
+	if info.IsTokuMX() {
+		desc = "TokuMX " + info.TokuMXVersion + " (MongoDB " + info.Version + ")"
+	}
+	desc += fmt.Sprintf(", storage engine %s", info.StorageEngine)
+	switch {
+	case info.IsMongos:
+		desc += ", mongos"
+	case info.ReplicaSet != "" && info.IsPrimary:
+		desc += ", primary of replica set " + info.ReplicaSet
+	case info.ReplicaSet != "":
+		desc += ", member of replica set " + info.ReplicaSet
+	}
+	return desc
+}
@@ -0,0 +1,34 @@
+package mongotools
+
+import (
+	"testing"
+)
+
+func TestLookupServerInfo(t *testing.T) {
+	defer func(saved []*cachedServerInfo) { serverInfos = saved }(serverInfos)
+	rs := &ServerInfo{ReplicaSet: "rs0"}
+	standalone := &ServerInfo{}
+	serverInfos = []*cachedServerInfo{
+		{servers: map[string]bool{"a:27017": true, "b:27017": true}, info: rs},
+		{servers: map[string]bool{"c:27017": true}, info: standalone},
+	}
+	tests := []struct {
+		servers []string
+		want    *ServerInfo
+	}{
+		{[]string{"a:27017", "b:27017"}, rs},
+		// a member went away
+		{[]string{"b:27017"}, rs},
+		// a member was added, and is then known
+		{[]string{"b:27017", "d:27017"}, rs},
+		{[]string{"d:27017"}, rs},
+		{[]string{"c:27017"}, standalone},
+		{[]string{"e:27017"}, nil},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if got := lookupServerInfo(test.servers); got != test.want {
+			t.Errorf("lookupServerInfo(%v) = %v, want %v", test.servers, got, test.want)
+		}
+	}
+}
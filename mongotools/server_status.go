@@ -0,0 +1,304 @@
+package mongotools
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"github.com/Tokutek/go-benchmark"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the fields of serverStatus sampled by default. Those a server does not have are skipped,
+// so the list covers MongoDB with mmapv1 or WiredTiger, and TokuMX (the "ft" section)
+const defaultServerStatusFields = "opcounters.insert,opcounters.query,opcounters.update,opcounters.delete,opcounters.getmore,opcounters.command," +
+	"globalLock.currentQueue.readers,globalLock.currentQueue.writers,locks.Global.timeAcquiringMicros.r,locks.Global.timeAcquiringMicros.w," +
+	"wiredTiger.cache.bytes currently in the cache,wiredTiger.cache.tracked dirty bytes in the cache,wiredTiger.transaction.transaction checkpoint total time (msecs)," +
+	"backgroundFlushing.flushes,backgroundFlushing.total_ms," +
+	"ft.cachetable.size.current,ft.locktree.size.current,ft.checkpoint.count,ft.checkpoint.time,ft.fsync.count,ft.fsync.time"
+
+// the fields of engineStatus sampled by default on TokuMX: checkpoints, fsyncs
+// and the cachetable, which are what stall a benchmark
+const defaultEngineStatusFields = "checkpoint: checkpoints taken,checkpoint: time spent during checkpoint (begin and end phases),checkpoint: last checkpoint began," +
+	"filesystem: fsync count,filesystem: fsync time," +
+	"cachetable: size current,cachetable: size limit,cachetable: size writing,cachetable: miss,cachetable: evictions"
+
+var (
+	serverStatusInterval = flag.Duration("serverStatusInterval", 10*time.Second, "interval at which the serverStatus of the server is sampled and logged during the benchmark, along with the throughput of the benchmark over the interval. 0 disables")
+	serverStatusFields   = flag.String("serverStatusFields", defaultServerStatusFields, "comma separated fields of serverStatus to sample, with \".\" between the names of nested fields. Fields the server does not have are skipped")
+	engineStatusFields   = flag.String("engineStatusFields", defaultEngineStatusFields, "comma separated fields of engineStatus to sample as well, on TokuMX. Fields the server does not have are skipped")
+	serverStatusOutput   = flag.String("serverStatusOutput", "", "if set, file to write the samples of the server status to, as CSV, along with the throughput of the benchmark since the previous sample")
+)
+
+// A benchmark.SampleMonitor that samples serverStatus (and on TokuMX, engineStatus) every
+// -serverStatusInterval, logging the throughput of the benchmark since the previous sample,
+// the fields given on the command line, and how much they changed, so that the stalls of
+// the benchmark can be matched to what the server did. With -serverStatusOutput, each
+// sample is also written to a CSV file.
+type serverStatusMonitor struct {
+	session      *mgo.Session
+	isTokuMX     bool
+	fields       []string
+	engineFields []string
+	out          *csv.Writer
+	header       bool // whether the header of the CSV file was written
+
+	quit chan bool
+	done chan bool
+
+	mutex sync.Mutex
+	// the results of the benchmark since the previous sample, by field name
+	counters map[string]uint64
+	// the names of the counters of the metric sample of the benchmark, in the order of the CSV file
+	counterNames []string
+	runStart     time.Time
+	lastTime     time.Time
+	lastValues   map[string]interface{}
+	unavailable  bool // true once serverStatus failed, so that it is not run again
+}
+
+// MonitorServerStatus makes the server session is connected to have its status sampled
+// during each run of the benchmark, as the serverStatus flags define, unless
+// -serverStatusInterval is 0. Benchmarks call it after Dial, before benchmark.Run.
+func MonitorServerStatus(session *mgo.Session) {
+	if *serverStatusInterval <= 0 {
+		return
+	}
+	// never closed, as monitors are used until the program ends
+	s := session.Copy()
+	s.SetMode(mgo.Strong, true)
+	m := &serverStatusMonitor{
+		session:  s,
+		isTokuMX: mustGetServerInfo(s).IsTokuMX(),
+		fields:   splitFields(*serverStatusFields),
+		counters: make(map[string]uint64)}
+	if m.isTokuMX {
+		m.engineFields = splitFields(*engineStatusFields)
+	} else if *engineStatusFields != defaultEngineStatusFields {
+		log.Println("engineStatus is only available on TokuMX, ignoring -engineStatusFields")
+	}
+	if *serverStatusOutput != "" {
+		f, err := os.Create(*serverStatusOutput)
+		if err != nil {
+			log.Fatal("Error creating ", *serverStatusOutput, ": ", err)
+		}
+		// never closed, as the file is written until the program ends
+		m.out = csv.NewWriter(f)
+	}
+	benchmark.AddMonitor(m)
+}
+
+// returns the non empty fields of the comma separated list s
+func splitFields(s string) []string {
+	var ret []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ret = append(ret, field)
+		}
+	}
+	return ret
+}
+
+// returns the value of the field at path in doc, in which "." separates the names of
+// nested fields, unless a field of doc has the whole path as its name. Returns nil if there is none
+func lookupField(doc bson.M, path string) interface{} {
+	if v, ok := doc[path]; ok {
+		return v
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		if sub, ok := doc[path[:i]].(bson.M); ok {
+			if v := lookupField(sub, path[i+1:]); v != nil {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// returns v as a float64 if it is a number
+func numericValue(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+func (m *serverStatusMonitor) Start() {
+	m.mutex.Lock()
+	m.runStart = time.Now()
+	m.lastTime = m.runStart
+	m.counters = make(map[string]uint64)
+	m.mutex.Unlock()
+	m.lastValues = m.status()
+	m.quit = make(chan bool)
+	m.done = make(chan bool)
+	go m.loop()
+}
+
+func (m *serverStatusMonitor) loop() {
+	defer close(m.done)
+	ticker := time.NewTicker(*serverStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+// adds the counters of sample, a metric sample of the benchmark, to those since the previous sample
+func (m *serverStatusMonitor) Sample(sample interface{}) {
+	v := reflect.ValueOf(sample)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := m.counterNames == nil
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		name := v.Type().Field(i).Name
+		switch f.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			m.counters[name] += uint64(f.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			m.counters[name] += f.Uint()
+		default:
+			continue
+		}
+		if names {
+			m.counterNames = append(m.counterNames, name)
+		}
+	}
+}
+
+// returns the values of the fields sampled, by field, nil if serverStatus failed
+func (m *serverStatusMonitor) status() map[string]interface{} {
+	if m.unavailable {
+		return nil
+	}
+	var status bson.M
+	if err := m.session.Run("serverStatus", &status); err != nil {
+		// serverStatus needs more privileges than the benchmark
+		log.Println("could not get the status of the server, not sampling it: ", err)
+		m.unavailable = true
+		return nil
+	}
+	values := make(map[string]interface{})
+	for _, field := range m.fields {
+		if v := lookupField(status, field); v != nil {
+			values[field] = v
+		}
+	}
+	if len(m.engineFields) > 0 {
+		var engineStatus bson.M
+		if err := m.session.Run("engineStatus", &engineStatus); err != nil {
+			log.Println("could not get the engine status of the server: ", err)
+		}
+		for _, field := range m.engineFields {
+			if v := lookupField(engineStatus, field); v != nil {
+				values[field] = v
+			}
+		}
+	}
+	return values
+}
+
+// samples the status of the server, logs it and writes it to the CSV file
+func (m *serverStatusMonitor) sample() {
+	values := m.status()
+	if values == nil {
+		return
+	}
+	now := time.Now()
+	m.mutex.Lock()
+	counters := m.counters
+	m.counters = make(map[string]uint64)
+	counterNames := m.counterNames
+	elapsed := now.Sub(m.lastTime)
+	sinceStart := now.Sub(m.runStart)
+	m.lastTime = now
+	m.mutex.Unlock()
+
+	fields := append(append([]string{}, m.fields...), m.engineFields...)
+	// the throughput of the benchmark first, so that the log alone matches it to the server
+	var logged []string
+	for _, name := range counterNames {
+		logged = append(logged, fmt.Sprintf("%s %.1f/s", name, float64(counters[name])/elapsed.Seconds()))
+	}
+	for _, field := range fields {
+		v, ok := values[field]
+		if !ok {
+			continue
+		}
+		s := fmt.Sprint(field, " ", v)
+		curr, isNumber := numericValue(v)
+		if last, wasNumber := numericValue(m.lastValues[field]); isNumber && wasNumber {
+			s += fmt.Sprintf(" (%+g)", curr-last)
+		}
+		logged = append(logged, s)
+	}
+	log.Printf("server: %s", strings.Join(logged, ", "))
+	m.lastValues = values
+
+	if m.out != nil {
+		m.writeRow(now, sinceStart, elapsed, counterNames, counters, fields, values)
+	}
+}
+
+// writes a sample to the CSV file: the time, the throughput of the benchmark
+// per second over elapsed, and the values of the fields
+func (m *serverStatusMonitor) writeRow(now time.Time, sinceStart time.Duration, elapsed time.Duration, names []string, counters map[string]uint64, fields []string, values map[string]interface{}) {
+	if names == nil {
+		// the benchmark has not reported results yet, so the columns of its throughput are unknown
+		return
+	}
+	if !m.header {
+		header := []string{"time", "elapsed"}
+		for _, name := range names {
+			header = append(header, name+"/s")
+		}
+		header = append(header, fields...)
+		m.out.Write(header)
+		m.header = true
+	}
+	row := []string{now.Format(time.RFC3339), strconv.FormatFloat(sinceStart.Seconds(), 'f', 1, 64)}
+	for _, name := range names {
+		row = append(row, strconv.FormatFloat(float64(counters[name])/elapsed.Seconds(), 'f', 1, 64))
+	}
+	for _, field := range fields {
+		if v, ok := values[field]; ok {
+			row = append(row, fmt.Sprint(v))
+		} else {
+			row = append(row, "")
+		}
+	}
+	m.out.Write(row)
+	m.out.Flush()
+	if err := m.out.Error(); err != nil {
+		log.Fatal("Error writing ", *serverStatusOutput, ": ", err)
+	}
+}
+
+func (m *serverStatusMonitor) Stop() {
+	close(m.quit)
+	<-m.done
+}
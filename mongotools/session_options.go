@@ -0,0 +1,73 @@
+package mongotools
+
+import (
+	"flag"
+	"labix.org/v2/mgo"
+	"log"
+	"strconv"
+	"time"
+)
+
+// command line variables for the write concern, read preference and timeouts of the benchmarks
+var (
+	writeConcernW  = flag.String("w", "1", "write concern: the number of servers that must acknowledge writes, \"majority\", or the name of a tag set. 0 means writes are not acknowledged (fire and forget)")
+	writeConcernJ  = flag.Bool("j", false, "write concern: whether writes must be committed to the journal before they are acknowledged")
+	writeFSync     = flag.Bool("fsync", false, "write concern: whether writes must be synced to disk before they are acknowledged")
+	wTimeout       = flag.Duration("wtimeout", 0, "write concern: how long to wait for -w servers to acknowledge a write before failing it, 0 means forever")
+	readPreference = flag.String("readPreference", "primary", "which members of a replica set reads go to: \"primary\", \"secondaryPreferred\" (reads go to a secondary, until the first write on the connection) or \"nearest\" (reads go to any member)")
+	socketTimeout  = flag.Duration("socketTimeout", 0, "how long an operation may wait on the server before it fails, 0 means mgo's default of a minute")
+	syncTimeout    = flag.Duration("syncTimeout", 0, "how long an operation waits for a suitable server to be available before it fails, 0 means mgo's default of a minute")
+)
+
+// returns the write concern defined by the command line flags "w", "j", "fsync"
+// and "wtimeout", or nil if writes are not to be acknowledged
+func WriteConcernFromFlags() *mgo.Safe {
+	safe := &mgo.Safe{J: *writeConcernJ, FSync: *writeFSync, WTimeout: int(*wTimeout / time.Millisecond)}
+	if n, err := strconv.Atoi(*writeConcernW); err == nil {
+		if n < 0 {
+			log.Fatal("invalid value for w: ", *writeConcernW)
+		}
+		if n == 0 {
+			if safe.J || safe.FSync {
+				log.Fatal("-j and -fsync require writes to be acknowledged, -w must not be 0")
+			}
+			return nil
+		}
+		safe.W = n
+	} else {
+		safe.WMode = *writeConcernW
+	}
+	return safe
+}
+
+// ApplySessionOptions sets the write concern, read preference and timeouts
+// defined by the command line flags on session. Copies of session made
+// afterwards, like those the benchmarks give their workers, have them too.
+//
+// mgo only knows three consistency modes, so "primary" maps to mgo.Strong,
+// "secondaryPreferred" to mgo.Monotonic and "nearest" to mgo.Eventual.
+// Other read preferences are rejected.
+func ApplySessionOptions(session *mgo.Session) {
+	session.SetSafe(WriteConcernFromFlags())
+	switch *readPreference {
+	case "primary":
+		session.SetMode(mgo.Strong, true)
+	case "secondaryPreferred":
+		session.SetMode(mgo.Monotonic, true)
+	case "nearest":
+		session.SetMode(mgo.Eventual, true)
+	default:
+		log.Fatal("invalid or unsupported value for readPreference: ", *readPreference)
+	}
+	if *socketTimeout > 0 {
+		session.SetSocketTimeout(*socketTimeout)
+	}
+	if *syncTimeout > 0 {
+		session.SetSyncTimeout(*syncTimeout)
+	}
+}
+
+// returns true if the readPreference flag sends reads to the primary
+func ReadsFromPrimary() bool {
+	return *readPreference == "primary"
+}
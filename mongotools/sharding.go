@@ -0,0 +1,201 @@
+package mongotools
+
+import (
+	"flag"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"strings"
+	"time"
+)
+
+// command line variables for sharding the collections
+var (
+	shardKey         = flag.String("shardKey", "", "comma separated fields of the key to shard the collections on when creating them, in the format of -primaryKey, with \"$hashed:\" before the field of a hashed key, e.g. \"$hashed:_id\". Empty means the benchmark's preferred shard key, which by default is none. Only for sharded clusters")
+	numInitialChunks = flag.Int("numInitialChunks", 0, "number of chunks each sharded collection is split into when created. Ranged shard keys can only be split on the keys of benchmarks that know their values. 0 means one chunk, or for hashed keys, the server's default")
+	distributeChunks = flag.Bool("distributeChunks", false, "after splitting each sharded collection, move its chunks round robin across the shards")
+	waitForBalancer  = flag.Bool("waitForBalancer", false, "wait for the balancer of the sharded cluster to stop migrating chunks before the benchmark starts")
+)
+
+// how long the balancer must be idle for it to be considered settled
+const balancerQuietPeriod = 10 * time.Second
+
+// Describes how a benchmark prefers its collections to be sharded, for CollectionOptions.
+// The shardKey, numInitialChunks, distributeChunks and waitForBalancer flags override it.
+type ShardingOptions struct {
+	// The shard key, in the format of mgo.Index.Key (e.g. []string{"$hashed:_id"} for a
+	// hashed key). nil means the collections are not sharded
+	Key []string
+	// The number of chunks each collection is split into when created, 0 meaning one,
+	// or for hashed keys, the server's default
+	NumInitialChunks int
+	// For ranged keys, returns the numChunks-1 values of key at which to split a collection
+	// into numChunks chunks, nil if the benchmark does not know how to split on key.
+	// See EvenSplitPoints
+	SplitPoints func(key bson.D, numChunks int) []bson.D
+	// Whether to move the chunks of each collection round robin across the shards, after splitting it
+	DistributeChunks bool
+	// Whether to wait for the balancer to stop migrating chunks before the benchmark starts
+	WaitForBalancer bool
+}
+
+// returns the split points of a ranged key on field, whose values are integers
+// from min to max (exclusive), into numChunks chunks of the same size
+func EvenSplitPoints(field string, min int64, max int64, numChunks int) []bson.D {
+	ret := make([]bson.D, 0, numChunks-1)
+	for i := 1; i < numChunks; i++ {
+		ret = append(ret, bson.D{{field, min + (max-min)*int64(i)/int64(numChunks)}})
+	}
+	return ret
+}
+
+// returns options with the sharding flags applied
+func shardingFromFlags(options ShardingOptions) ShardingOptions {
+	if *shardKey != "" {
+		options.Key = strings.Split(*shardKey, ",")
+	}
+	if *numInitialChunks > 0 {
+		options.NumInitialChunks = *numInitialChunks
+	}
+	options.DistributeChunks = options.DistributeChunks || *distributeChunks
+	options.WaitForBalancer = options.WaitForBalancer || *waitForBalancer
+	return options
+}
+
+// returns true if key, a shard key document, is hashed
+func isHashedKey(key bson.D) bool {
+	for _, elem := range key {
+		if elem.Value == "hashed" {
+			return true
+		}
+	}
+	return false
+}
+
+// runs cmd on the admin database, logging a fatal error if it fails
+func runAdminCommand(s *mgo.Session, cmd bson.D, result interface{}) {
+	if err := s.Run(cmd, result); err != nil {
+		log.Fatal("Received error ", err, " when running ", cmd[0].Name, ", exiting")
+	}
+}
+
+// enables sharding on the database dbname, if it is not enabled already
+func enableSharding(s *mgo.Session, dbname string) {
+	fmt.Println("enabling sharding on database: ", dbname)
+	var result bson.M
+	err := s.Run(bson.D{{"enableSharding", dbname}}, &result)
+	if err != nil && !strings.Contains(err.Error(), "already") {
+		log.Fatal("Received error ", err, " when enabling sharding on ", dbname, ", exiting")
+	}
+}
+
+// shards the collection dbname.collname, which was just created, as options define
+func shardCollection(s *mgo.Session, dbname string, collname string, options ShardingOptions) {
+	ns := dbname + "." + collname
+	_, key := indexKey(options.Key)
+	hashed := isHashedKey(key)
+	fmt.Println("sharding collection ", ns, " on ", key)
+	cmd := bson.D{{"shardCollection", ns}, {"key", key}}
+	if hashed && options.NumInitialChunks > 0 {
+		cmd = append(cmd, bson.DocElem{"numInitialChunks", options.NumInitialChunks})
+	}
+	var result bson.M
+	runAdminCommand(s, cmd, &result)
+	if !hashed && options.NumInitialChunks > 1 {
+		var points []bson.D
+		if options.SplitPoints != nil {
+			points = options.SplitPoints(key, options.NumInitialChunks)
+		}
+		if points == nil {
+			log.Fatal("this benchmark cannot split its collections on ", key, ", use a hashed shard key or leave -numInitialChunks at 0")
+		}
+		for _, point := range points {
+			runAdminCommand(s, bson.D{{"split", ns}, {"middle", point}}, &result)
+		}
+	}
+	if options.DistributeChunks {
+		distributeCollectionChunks(s, ns)
+	}
+}
+
+// a chunk of a sharded collection, as stored in config.chunks
+type chunkInfo struct {
+	Min   bson.Raw "min"
+	Max   bson.Raw "max"
+	Shard string   "shard"
+}
+
+// returns the chunks of the sharded collection ns, in the order of the shard key
+func collectionChunks(s *mgo.Session, ns string) []chunkInfo {
+	config := s.DB("config")
+	var chunks []chunkInfo
+	if err := config.C("chunks").Find(bson.M{"ns": ns}).Sort("min").All(&chunks); err != nil {
+		log.Fatal("Received error ", err, " when reading the chunks of ", ns)
+	}
+	if len(chunks) == 0 {
+		// since MongoDB 5.0, chunks are stored by the uuid of their collection
+		var coll struct {
+			UUID interface{} "uuid"
+		}
+		if err := config.C("collections").FindId(ns).One(&coll); err != nil {
+			log.Fatal("Received error ", err, " when reading the sharding of ", ns)
+		}
+		if err := config.C("chunks").Find(bson.M{"uuid": coll.UUID}).Sort("min").All(&chunks); err != nil {
+			log.Fatal("Received error ", err, " when reading the chunks of ", ns)
+		}
+	}
+	return chunks
+}
+
+// moves the chunks of the sharded collection ns round robin across the shards of the cluster
+func distributeCollectionChunks(s *mgo.Session, ns string) {
+	var shards struct {
+		Shards []struct {
+			ID string "_id"
+		} "shards"
+	}
+	runAdminCommand(s, bson.D{{"listShards", 1}}, &shards)
+	if len(shards.Shards) == 0 {
+		log.Fatal("the cluster has no shards")
+	}
+	chunks := collectionChunks(s, ns)
+	fmt.Println("distributing ", len(chunks), " chunks of ", ns, " across ", len(shards.Shards), " shards")
+	for i, chunk := range chunks {
+		to := shards.Shards[i%len(shards.Shards)].ID
+		if chunk.Shard == to {
+			continue
+		}
+		var result bson.M
+		runAdminCommand(s, bson.D{{"moveChunk", ns}, {"bounds", []bson.Raw{chunk.Min, chunk.Max}}, {"to", to}}, &result)
+	}
+}
+
+// returns true if the balancer is migrating chunks
+func balancerActive(s *mgo.Session) bool {
+	if mustGetServerInfo(s).HasCommand("balancerStatus") {
+		var status struct {
+			InBalancerRound bool "inBalancerRound"
+		}
+		runAdminCommand(s, bson.D{{"balancerStatus", 1}}, &status)
+		return status.InBalancerRound
+	}
+	// before MongoDB 3.4, the balancer holds its lock only while it runs
+	n, err := s.DB("config").C("locks").Find(bson.M{"_id": "balancer", "state": bson.M{"$gt": 0}}).Count()
+	if err != nil {
+		log.Fatal("Received error ", err, " when reading the state of the balancer")
+	}
+	return n > 0
+}
+
+// waits until the balancer has not migrated chunks for balancerQuietPeriod
+func waitForBalancerToSettle(s *mgo.Session) {
+	fmt.Println("waiting for the balancer to settle")
+	quietSince := time.Now()
+	for time.Since(quietSince) < balancerQuietPeriod {
+		if balancerActive(s) {
+			quietSince = time.Now()
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -1,14 +1,21 @@
 package mongotools
 
 import (
+	cryptorand "crypto/rand"
 	"errors"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"log"
+	"sync"
 )
 
 // A Transaction manages the lifetime of a multi-statement transaction.
-// If the server is running basic MongoDB instead of TokuMX, this will be a no-op.
+// On TokuMX, it uses TokuMX's transactions, which apply to all statements
+// run on the connection of the session. On MongoDB 4.0 and later replica sets
+// (4.2 and later sharded clusters), it uses multi-document transactions on a
+// server session, which only apply to statements run with the methods of the
+// Transaction (Find, Insert, Update, ...), so those should be used.
+// On other servers, this will be a no-op.
 //
 // Example:
 //
@@ -18,36 +25,65 @@ import (
 //     }
 //     defer txn.Close()
 //     // ...
+//     if err := txn.Update(coll, bson.M{"_id": 1}, bson.M{"$inc": bson.M{"n": 1}}); err != nil {
+//         log.Fatal(err)
+//     }
 //     if success {
 //         if err := txn.Commit(); err != nil {
 //             log.Fatal(err)
 //         }
 //     }
 type Transaction struct {
-	DB   *mgo.Database
-	live bool
+	DB *mgo.Database
+	// The server DB is on. If nil, Begin gets it with GetServerInfo
+	Server *ServerInfo
+	live   bool
+
+	// for MongoDB transactions, which a Transaction uses if session is true
+	session     bool
+	lsid        bson.M // the id of the server session, kept when the Transaction is reused
+	txnNumber   int64  // increased by each Begin, identifies the transaction within the session
+	started     bool   // whether a statement has started the transaction on the server
+	readConcern string
 }
 
+// so that falling back to statements outside of transactions is only logged once
+var noTransactionsOnce sync.Once
+
 // Begin starts the transaction and accepts an optional isolation parameter.
 // The valid values for isolation are "mvcc" (the default), "serializable", and "readUncommitted".
+// On MongoDB, "mvcc" and "serializable" run with read concern "snapshot", and
+// "readUncommitted" with read concern "local".
 // After a successful begin, the application is responsible for calling Close().
+// A Transaction may be begun again once it is committed or rolled back.
 func (txn *Transaction) Begin(isos ...string) error {
-	if !IsTokuMX(txn.DB) {
+	if txn.Server == nil {
+		server, err := GetServerInfo(txn.DB.Session)
+		if err != nil {
+			return err
+		}
+		txn.Server = server
+	}
+	iso := "mvcc"
+	if len(isos) == 1 {
+		iso = isos[0]
+	}
+	if iso != "serializable" && iso != "mvcc" && iso != "readUncommitted" {
+		return errors.New("invalid isolation type")
+	}
+	if txn.Server.hasSessionTransactions() {
+		return txn.beginSession(iso)
+	}
+	if !txn.Server.IsTokuMX() {
+		noTransactionsOnce.Do(func() {
+			log.Println("the server does not support transactions, running their statements without them")
+		})
 		return nil
 	}
 
 	cmd := bson.M{"beginTransaction": 1}
 	if len(isos) == 1 {
-		switch isos[0] {
-		case "serializable":
-			fallthrough
-		case "mvcc":
-			fallthrough
-		case "readUncommitted":
-			cmd[isos[0]] = 1
-		default:
-			return errors.New("invalid isolation type")
-		}
+		cmd[iso] = 1
 	}
 
 	var res bson.M
@@ -58,8 +94,62 @@ func (txn *Transaction) Begin(isos ...string) error {
 	return nil
 }
 
-// Commit commits the current transaction.
+// begins a MongoDB transaction. Nothing is sent to the server: the transaction
+// starts with its first statement, and the id of the session is made here,
+// as drivers do
+func (txn *Transaction) beginSession(iso string) error {
+	if txn.lsid == nil {
+		id := make([]byte, 16)
+		if _, err := cryptorand.Read(id); err != nil {
+			return err
+		}
+		// a random (version 4) UUID
+		id[6] = (id[6] & 0x0f) | 0x40
+		id[8] = (id[8] & 0x3f) | 0x80
+		txn.lsid = bson.M{"id": bson.Binary{Kind: 0x04, Data: id}}
+	}
+	txn.readConcern = "snapshot"
+	if iso == "readUncommitted" {
+		txn.readConcern = "local"
+	}
+	txn.txnNumber++
+	txn.started = false
+	txn.session = true
+	txn.live = true
+	return nil
+}
+
+// runs commitTransaction or abortTransaction for the current MongoDB transaction.
+// If no statement started it, there is nothing to end on the server. A transaction
+// whose commit fails is still live, so that Rollback aborts it, rather than it holding
+// its locks and snapshot on the server until it expires
+func (txn *Transaction) endSession(command string) error {
+	if !txn.started {
+		txn.live = false
+		return nil
+	}
+	var res bson.M
+	err := txn.DB.Session.DB("admin").Run(bson.D{
+		{command, 1},
+		{"lsid", txn.lsid},
+		{"txnNumber", txn.txnNumber},
+		{"autocommit", false}}, &res)
+	if err == nil || command == "abortTransaction" {
+		// if aborting fails, the server aborted the transaction already, or will when it expires
+		txn.live = false
+	}
+	return err
+}
+
+// Commit commits the current transaction. If no transaction was begun
+// (the server does not support them), this is a no-op.
 func (txn *Transaction) Commit() error {
+	if !txn.live {
+		return nil
+	}
+	if txn.session {
+		return txn.endSession("commitTransaction")
+	}
 	var res bson.M
 	if err := txn.DB.Run(bson.M{"commitTransaction": 1}, &res); err != nil {
 		return err
@@ -68,8 +158,15 @@ func (txn *Transaction) Commit() error {
 	return nil
 }
 
-// Rollback rolls the current transaction back.
+// Rollback rolls the current transaction back. If no transaction was begun
+// (the server does not support them), this is a no-op.
 func (txn *Transaction) Rollback() error {
+	if !txn.live {
+		return nil
+	}
+	if txn.session {
+		return txn.endSession("abortTransaction")
+	}
 	var res bson.M
 	if err := txn.DB.Run(bson.M{"rollbackTransaction": 1}, &res); err != nil {
 		return err
@@ -87,3 +184,88 @@ func (txn *Transaction) Close() {
 		txn.live = false
 	}
 }
+
+// Defines how RunInTransactionWithOptions runs a transaction
+type TransactionOptions struct {
+	// The isolation of the transaction, as for Begin. "" means the default, "mvcc"
+	Isolation string
+	// How attempts of the transaction that fail with a retryable error, such as
+	// a TokuMX lock conflict, are retried
+	Retry RetryPolicy
+	// The server the transaction runs on. If nil, it is obtained with GetServerInfo
+	Server *ServerInfo
+	// If not nil, the Transaction the transaction is run with, so that a Work running
+	// many transactions reuses the same server session. Its DB must be the db passed.
+	Transaction *Transaction
+}
+
+// The outcome of running a transaction with RunInTransaction, for Works to report
+type TransactionResult struct {
+	NumCommits uint64 // 1 if the transaction committed, 0 otherwise
+	NumAborts  uint64 // number of attempts rolled back, because the body or the commit failed
+	NumRetries uint64 // number of attempts after the first
+}
+
+// RunInTransaction runs body in a transaction on db with the given isolation (see Begin),
+// retrying as defined by DefaultRetryPolicy. See RunInTransactionWithOptions.
+func RunInTransaction(db *mgo.Database, isolation string, body func(txn *Transaction) error) (TransactionResult, error) {
+	return RunInTransactionWithOptions(db, TransactionOptions{Isolation: isolation, Retry: DefaultRetryPolicy()}, body)
+}
+
+// RunInTransactionWithOptions begins a transaction, runs body, and commits if body returns nil.
+// body should run its statements with the methods of txn, so that they are part of the transaction on MongoDB.
+// If body or the commit returns an error, the transaction is rolled back, and if the error
+// is retryable under options.Retry, the whole transaction is run again, up to options.Retry.MaxAttempts times.
+// Returns how many commits, aborts and retries happened, and the error of the last attempt.
+//
+// Example:
+//
+//     res, err := mongotools.RunInTransaction(session.DB("admin"), "serializable", func(txn *mongotools.Transaction) error {
+//         return txn.Update(coll, bson.M{"_id": 1}, bson.M{"$inc": bson.M{"n": 1}})
+//     })
+func RunInTransactionWithOptions(db *mgo.Database, options TransactionOptions, body func(txn *Transaction) error) (TransactionResult, error) {
+	var result TransactionResult
+	txn := options.Transaction
+	if txn == nil {
+		txn = &Transaction{DB: db}
+	}
+	if txn.Server == nil {
+		txn.Server = options.Server
+	}
+	retries, err := options.Retry.Do(func() error {
+		var err error
+		if options.Isolation == "" {
+			err = txn.Begin()
+		} else {
+			err = txn.Begin(options.Isolation)
+		}
+		if err == nil {
+			if err = body(txn); err == nil {
+				err = txn.Commit()
+			}
+			if err != nil {
+				result.NumAborts++
+			}
+		}
+		if err != nil {
+			// errors of Begin are handled as those of the body and the commit, so
+			// that after a socket error, the next attempt does not use the dead socket
+			if IsSocketError(err) {
+				// the connection is gone, so rolling back on it would fail. On TokuMX, the
+				// transaction went with it, and a MongoDB transaction is aborted by the next
+				// Begin. The session must be refreshed before the next attempt uses it
+				txn.DB.Session.Refresh()
+			} else {
+				// the server may already have aborted the transaction, in which
+				// case rolling back fails, and there is nothing more to do
+				txn.Rollback()
+			}
+			txn.live = false
+			return err
+		}
+		result.NumCommits++
+		return nil
+	})
+	result.NumRetries = uint64(retries)
+	return result, err
+}
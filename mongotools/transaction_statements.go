@@ -0,0 +1,173 @@
+package mongotools
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+)
+
+// The statements of a Transaction. On MongoDB, statements are only part of a
+// transaction if they carry its session id and transaction number, which mgo
+// cannot add to its operations, so they are run as commands. Otherwise (TokuMX,
+// or no transactions at all), they are run with the operations of mgo.
+
+// a batch of the results of a command that returns a cursor, and the cursor to get the next batch from
+type cursorBatch struct {
+	Cursor struct {
+		ID         int64      "id"
+		FirstBatch []bson.Raw "firstBatch"
+		NextBatch  []bson.Raw "nextBatch"
+	} "cursor"
+}
+
+// adds the fields that make cmd a statement of the current MongoDB transaction.
+// The first statement starts the transaction on the server
+func (txn *Transaction) statement(cmd bson.D) bson.D {
+	cmd = append(cmd,
+		bson.DocElem{"lsid", txn.lsid},
+		bson.DocElem{"txnNumber", txn.txnNumber},
+		bson.DocElem{"autocommit", false})
+	if !txn.started {
+		cmd = append(cmd,
+			bson.DocElem{"startTransaction", true},
+			bson.DocElem{"readConcern", bson.M{"level": txn.readConcern}})
+		txn.started = true
+	}
+	return cmd
+}
+
+// returns true if statements must be run as commands of a MongoDB transaction
+func (txn *Transaction) inSession() bool {
+	return txn.live && txn.session
+}
+
+// runs cmd, a command returning a cursor, as a statement of the transaction,
+// and unmarshals all its results into result, a pointer to a slice
+func (txn *Transaction) runCursorCommand(db *mgo.Database, collname string, cmd bson.D, result interface{}) error {
+	resultv := reflect.ValueOf(result).Elem()
+	resultv.Set(resultv.Slice(0, 0))
+	var batch cursorBatch
+	if err := db.Run(txn.statement(cmd), &batch); err != nil {
+		return err
+	}
+	docs := batch.Cursor.FirstBatch
+	for {
+		for _, doc := range docs {
+			elem := reflect.New(resultv.Type().Elem())
+			if err := doc.Unmarshal(elem.Interface()); err != nil {
+				return err
+			}
+			resultv.Set(reflect.Append(resultv, elem.Elem()))
+		}
+		if batch.Cursor.ID == 0 {
+			return nil
+		}
+		id := batch.Cursor.ID
+		batch = cursorBatch{}
+		if err := db.Run(txn.statement(bson.D{{"getMore", id}, {"collection", collname}}), &batch); err != nil {
+			return err
+		}
+		docs = batch.Cursor.NextBatch
+	}
+}
+
+// Find runs a query on coll as a statement of the transaction, and unmarshals
+// all the documents it returns into result, a pointer to a slice. projection
+// may be nil, and sort is in the format of mgo.Query.Sort (e.g. "-ts").
+func (txn *Transaction) Find(coll *mgo.Collection, filter interface{}, projection interface{}, result interface{}, sort ...string) error {
+	if !txn.inSession() {
+		q := coll.Find(filter).Select(projection)
+		if len(sort) > 0 {
+			q = q.Sort(sort...)
+		}
+		return q.All(result)
+	}
+	cmd := bson.D{{"find", coll.Name}, {"filter", filter}}
+	if projection != nil {
+		cmd = append(cmd, bson.DocElem{"projection", projection})
+	}
+	if len(sort) > 0 {
+		_, sortDoc := indexKey(sort)
+		cmd = append(cmd, bson.DocElem{"sort", sortDoc})
+	}
+	return txn.runCursorCommand(coll.Database, coll.Name, cmd, result)
+}
+
+// Aggregate runs an aggregation pipeline on coll as a statement of the transaction,
+// and unmarshals all the documents it returns into result, a pointer to a slice.
+func (txn *Transaction) Aggregate(coll *mgo.Collection, pipeline interface{}, result interface{}) error {
+	if !txn.inSession() {
+		return coll.Pipe(pipeline).Iter().All(result)
+	}
+	cmd := bson.D{{"aggregate", coll.Name}, {"pipeline", pipeline}, {"cursor", bson.M{}}}
+	return txn.runCursorCommand(coll.Database, coll.Name, cmd, result)
+}
+
+// Distinct finds the distinct values of key in the documents of coll matching
+// filter, as a statement of the transaction, and unmarshals them into result, a pointer to a slice.
+func (txn *Transaction) Distinct(coll *mgo.Collection, key string, filter interface{}, result interface{}) error {
+	if !txn.inSession() {
+		return coll.Find(filter).Distinct(key, result)
+	}
+	var res struct {
+		Values bson.Raw "values"
+	}
+	cmd := bson.D{{"distinct", coll.Name}, {"key", key}, {"query", filter}}
+	if err := coll.Database.Run(txn.statement(cmd), &res); err != nil {
+		return err
+	}
+	return res.Values.Unmarshal(result)
+}
+
+// Insert inserts docs into coll as a statement of the transaction.
+func (txn *Transaction) Insert(coll *mgo.Collection, docs ...interface{}) error {
+	if !txn.inSession() {
+		return coll.Insert(docs...)
+	}
+	var res writeCommandResult
+	cmd := bson.D{{"insert", coll.Name}, {"documents", docs}}
+	if err := coll.Database.Run(txn.statement(cmd), &res); err != nil {
+		return err
+	}
+	return res.err()
+}
+
+// Update updates the first document of coll matching selector as a statement of the transaction.
+// As mgo.Collection.Update, returns mgo.ErrNotFound if no document matched.
+func (txn *Transaction) Update(coll *mgo.Collection, selector interface{}, update interface{}) error {
+	if !txn.inSession() {
+		return coll.Update(selector, update)
+	}
+	var res writeCommandResult
+	cmd := bson.D{{"update", coll.Name}, {"updates", []bson.M{{"q": selector, "u": update}}}}
+	if err := coll.Database.Run(txn.statement(cmd), &res); err != nil {
+		return err
+	}
+	if err := res.err(); err != nil {
+		return err
+	}
+	if res.N == 0 {
+		return mgo.ErrNotFound
+	}
+	return nil
+}
+
+// Remove removes the first document of coll matching selector as a statement of the transaction.
+// As mgo.Collection.Remove, returns mgo.ErrNotFound if no document matched.
+func (txn *Transaction) Remove(coll *mgo.Collection, selector interface{}) error {
+	if !txn.inSession() {
+		return coll.Remove(selector)
+	}
+	var res writeCommandResult
+	cmd := bson.D{{"delete", coll.Name}, {"deletes", []bson.M{{"q": selector, "limit": 1}}}}
+	if err := coll.Database.Run(txn.statement(cmd), &res); err != nil {
+		return err
+	}
+	if err := res.err(); err != nil {
+		return err
+	}
+	if res.N == 0 {
+		return mgo.ErrNotFound
+	}
+	return nil
+}
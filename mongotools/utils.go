@@ -3,14 +3,18 @@ package mongotools
 import (
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
-	"log"
 )
 
 // IsTokuMX determines if the server connected to is TokuMX.
+// The answer is cached, see GetServerInfo.
 func IsTokuMX(db *mgo.Database) bool {
-	var result bson.M
-	if err := db.Run("buildInfo", &result); err != nil {
-		log.Fatal(err)
-	}
-	return result["tokumxVersion"] != nil
+	return mustGetServerInfo(db.Session).IsTokuMX()
+}
+
+// the first batch of results of a command that returns a cursor, like listCollections.
+// Commands whose results fit in a batch are the only ones run here.
+type cursorResult struct {
+	Cursor struct {
+		FirstBatch []bson.Raw "firstBatch"
+	} "cursor"
 }
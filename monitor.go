@@ -0,0 +1,56 @@
+package benchmark
+
+import (
+	"sync"
+)
+
+// A Monitor observes what a benchmark runs against while Run runs it, for
+// instance to take statistics of the server before and after the run. Monitors
+// are added with AddMonitor. Each run (and each phase of a Sweep) starts them,
+// in the order they were added, before its workers start, and stops them, in
+// reverse order, after its workers have finished and their results were reported.
+type Monitor interface {
+	Start()
+	Stop()
+}
+
+// A SampleMonitor is a Monitor that is also given the results of the workers
+// each time they are reported, so that it can report what it observes in the
+// same time series as the throughput of the benchmark.
+type SampleMonitor interface {
+	Monitor
+	// called once per second with the results recorded by all workers since the
+	// previous call, as a value of the type of the metric sample passed to Run
+	Sample(sample interface{})
+}
+
+var (
+	monitorsMutex sync.Mutex
+	monitors      []Monitor
+)
+
+// AddMonitor adds m to the Monitors of the runs that start after it is added.
+func AddMonitor(m Monitor) {
+	monitorsMutex.Lock()
+	defer monitorsMutex.Unlock()
+	monitors = append(monitors, m)
+}
+
+// starts the Monitors added so far, returning them
+func startMonitors() []Monitor {
+	monitorsMutex.Lock()
+	started := make([]Monitor, len(monitors))
+	copy(started, monitors)
+	monitorsMutex.Unlock()
+	for _, m := range started {
+		m.Start()
+	}
+	return started
+}
+
+// stops the Monitors started by startMonitors
+func stopMonitors(started []Monitor) {
+	for i := len(started) - 1; i >= 0; i-- {
+		started[i].Stop()
+	}
+}
@@ -0,0 +1,143 @@
+package benchmark
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+// command line variables for profiling the benchmark client
+var (
+	profileDir      = flag.String("profileDir", "", "if set, directory to write pprof profiles of the benchmark client to, one file per profile per run")
+	profiles        = flag.String("profiles", "cpu,heap", "comma separated list of the profiles to capture when -profileDir is set. Can contain \"cpu\", \"heap\", \"block\" and \"mutex\"")
+	profileStart    = flag.Duration("profileStart", 0, "how long into the run to start profiling")
+	profileDuration = flag.Duration("profileDuration", 0, "how long to profile for, 0 means until the run ends")
+)
+
+// counts the runs that were profiled, so that each run (for instance, each phase
+// of a sweep) writes its own files
+var numProfiledRuns = 0
+
+// profiles the process for a window of a run, as defined by the flags above
+type profiler struct {
+	kinds   map[string]bool
+	prefix  string
+	cpuFile *os.File
+	started bool
+	quit    chan bool
+	done    chan bool
+}
+
+func validProfileKind(kind string) bool {
+	return kind == "cpu" || kind == "heap" || kind == "block" || kind == "mutex"
+}
+
+// starts a profiler if -profileDir is set, otherwise returns nil. Profiling begins
+// after -profileStart in a background thread.
+func startProfiler() *profiler {
+	if *profileDir == "" {
+		return nil
+	}
+	p := &profiler{kinds: make(map[string]bool), quit: make(chan bool), done: make(chan bool)}
+	for _, kind := range strings.Split(*profiles, ",") {
+		if !validProfileKind(kind) {
+			log.Fatal("invalid value for profiles: ", *profiles)
+		}
+		p.kinds[kind] = true
+	}
+	if err := os.MkdirAll(*profileDir, 0755); err != nil {
+		log.Fatal("Error creating ", *profileDir, ": ", err)
+	}
+	numProfiledRuns++
+	p.prefix = filepath.Join(*profileDir, fmt.Sprintf("run%d-", numProfiledRuns))
+	go p.loop()
+	return p
+}
+
+func (p *profiler) loop() {
+	defer close(p.done)
+	select {
+	case <-p.quit:
+		return
+	case <-time.After(*profileStart):
+	}
+	p.begin()
+	if *profileDuration <= 0 {
+		<-p.quit
+	} else {
+		select {
+		case <-p.quit:
+		case <-time.After(*profileDuration):
+		}
+	}
+	p.end()
+}
+
+func (p *profiler) begin() {
+	log.Println("profiling the client, writing profiles to ", p.prefix+"*.pprof")
+	if p.kinds["cpu"] {
+		f, err := os.Create(p.prefix + "cpu.pprof")
+		if err != nil {
+			log.Fatal("Error creating cpu profile: ", err)
+		}
+		if err = pprof.StartCPUProfile(f); err != nil {
+			log.Fatal("Error starting cpu profile: ", err)
+		}
+		p.cpuFile = f
+	}
+	if p.kinds["block"] {
+		runtime.SetBlockProfileRate(1)
+	}
+	if p.kinds["mutex"] {
+		runtime.SetMutexProfileFraction(1)
+	}
+	p.started = true
+}
+
+// writes the named profile to its file
+func (p *profiler) writeProfile(name string) {
+	f, err := os.Create(p.prefix + name + ".pprof")
+	if err != nil {
+		log.Fatal("Error creating ", name, " profile: ", err)
+	}
+	defer f.Close()
+	if err = pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		log.Fatal("Error writing ", name, " profile: ", err)
+	}
+}
+
+func (p *profiler) end() {
+	if p.cpuFile != nil {
+		pprof.StopCPUProfile()
+		p.cpuFile.Close()
+	}
+	if p.kinds["heap"] {
+		// so the profile reflects all the allocations made so far
+		runtime.GC()
+		p.writeProfile("heap")
+	}
+	if p.kinds["block"] {
+		p.writeProfile("block")
+		runtime.SetBlockProfileRate(0)
+	}
+	if p.kinds["mutex"] {
+		p.writeProfile("mutex")
+		runtime.SetMutexProfileFraction(0)
+	}
+	log.Println("done profiling the client")
+}
+
+// ends profiling if it is still going on. Must be called when the run ends.
+func (p *profiler) stop() {
+	close(p.quit)
+	<-p.done
+	if !p.started {
+		log.Println("run ended before -profileStart, ", *profileStart, ", no profiles were written")
+	}
+}
@@ -0,0 +1,208 @@
+package benchmark
+
+import (
+	"log"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// how often the results of the workers are totaled and sent to the reporter
+const snapshotInterval = time.Second
+
+// describes the counters of a metric sample (the struct passed to Run):
+// the indexes of its integer fields, and their names
+type sampleLayout struct {
+	sampleType reflect.Type
+	fields     []int          // indexes of the counter fields in sampleType
+	byName     map[string]int // field name to position in fields
+}
+
+func isCounterKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// returns the uint64 to add to a counter for the value of an integer field
+func counterValue(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	}
+	return v.Uint()
+}
+
+func newSampleLayout(metricSample interface{}) *sampleLayout {
+	t := reflect.TypeOf(metricSample)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		log.Fatal("metric sample must be a struct or a pointer to a struct, got ", t)
+	}
+	l := &sampleLayout{sampleType: t, byName: make(map[string]int)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath == "" && isCounterKind(f.Type.Kind()) {
+			l.byName[f.Name] = len(l.fields)
+			l.fields = append(l.fields, i)
+		}
+	}
+	return l
+}
+
+// returns a value of the sample type whose counters are set to counters
+func (l *sampleLayout) makeSample(counters []uint64) interface{} {
+	v := reflect.New(l.sampleType).Elem()
+	for i, field := range l.fields {
+		f := v.Field(field)
+		if f.Kind() >= reflect.Uint && f.Kind() <= reflect.Uint64 {
+			f.SetUint(counters[i])
+		} else {
+			f.SetInt(int64(counters[i]))
+		}
+	}
+	return v.Interface()
+}
+
+// A Recorder accumulates the results of the Work of one worker thread.
+// Each worker has its own Recorder, so recording a result never contends
+// with other workers; once per interval, the totals of all Recorders are
+// read and sent to the reporter. As a result, Works may record every
+// operation as it completes, without batching results.
+type Recorder struct {
+	layout    *sampleLayout
+	counters  []uint64
+	latencies LatencyHistogram
+	// for each type of result added, the position in counters of each of its fields, or -1
+	mappings map[reflect.Type][]int
+}
+
+func newRecorder(layout *sampleLayout) *Recorder {
+	return &Recorder{layout: layout, counters: make([]uint64, len(layout.fields)), mappings: make(map[reflect.Type][]int)}
+}
+
+// returns, for each field of t, the counter it is added to, or -1 if the
+// metric sample has no integer field of that name
+func (r *Recorder) mapping(t reflect.Type) []int {
+	if m, ok := r.mappings[t]; ok {
+		return m
+	}
+	m := make([]int, t.NumField())
+	for i := range m {
+		m[i] = -1
+		f := t.Field(i)
+		if pos, ok := r.layout.byName[f.Name]; ok && isCounterKind(f.Type.Kind()) {
+			m[i] = pos
+		}
+	}
+	r.mappings[t] = m
+	return m
+}
+
+// Add records result, a struct (or pointer to a struct) of counters. Each integer
+// field of result is added to the field of the same name of the metric sample passed
+// to Run. Fields the metric sample does not have are ignored, so a Work may report
+// results of a different type than the sample. Add must only be called by the
+// worker that owns r.
+func (r *Recorder) Add(result interface{}) {
+	v := reflect.ValueOf(result)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		log.Fatal("results must be structs or pointers to structs, got ", v.Type())
+	}
+	for i, pos := range r.mapping(v.Type()) {
+		if pos >= 0 {
+			if n := counterValue(v.Field(i)); n != 0 {
+				atomic.AddUint64(&r.counters[pos], n)
+			}
+		}
+	}
+}
+
+// Latencies returns the latencies of the calls to Work.Do made by this worker
+func (r *Recorder) Latencies() *LatencyHistogram {
+	return &r.latencies
+}
+
+// sums the counters of recorders into totals, reading each atomically
+func sumCounters(recorders []*Recorder, totals []uint64) {
+	for i := range totals {
+		totals[i] = 0
+	}
+	for _, r := range recorders {
+		for i := range r.counters {
+			totals[i] += atomic.LoadUint64(&r.counters[i])
+		}
+	}
+}
+
+// reads the recorders of all workers every snapshotInterval, and sends the
+// results recorded since the previous snapshot over metrics as a metric sample
+type snapshotter struct {
+	layout    *sampleLayout
+	recorders []*Recorder
+	metrics   chan<- interface{}
+	monitors  []Monitor // those that are SampleMonitors are also given the metric samples
+	last      []uint64
+	curr      []uint64
+	quit      chan bool
+	done      chan bool
+}
+
+func startSnapshotter(layout *sampleLayout, recorders []*Recorder, metrics chan<- interface{}, monitors []Monitor) *snapshotter {
+	s := &snapshotter{
+		layout:    layout,
+		recorders: recorders,
+		metrics:   metrics,
+		monitors:  monitors,
+		last:      make([]uint64, len(layout.fields)),
+		curr:      make([]uint64, len(layout.fields)),
+		quit:      make(chan bool),
+		done:      make(chan bool)}
+	go s.loop()
+	return s
+}
+
+func (s *snapshotter) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			s.snapshot()
+			return
+		case <-ticker.C:
+			s.snapshot()
+		}
+	}
+}
+
+func (s *snapshotter) snapshot() {
+	sumCounters(s.recorders, s.curr)
+	delta := make([]uint64, len(s.curr))
+	for i := range s.curr {
+		delta[i] = s.curr[i] - s.last[i]
+	}
+	s.last, s.curr = s.curr, s.last
+	sample := s.layout.makeSample(delta)
+	s.metrics <- sample
+	for _, m := range s.monitors {
+		if sm, ok := m.(SampleMonitor); ok {
+			sm.Sample(sample)
+		}
+	}
+}
+
+// takes a last snapshot, so that all recorded results are reported, and stops
+func (s *snapshotter) stop() {
+	close(s.quit)
+	<-s.done
+}
@@ -0,0 +1,163 @@
+package benchmark
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"time"
+)
+
+var (
+	clientStatsInterval = flag.Duration("clientStatsInterval", 10*time.Second, "interval at which the CPU, memory, GC and goroutine usage of this process are sampled and reported, 0 disables")
+)
+
+// above these, the client itself is likely limiting the throughput of the benchmark.
+// busyCPUFraction applies to all the cores Go may use, and to a single core, which
+// limits a client that does its work in one goroutine however many cores it has
+const (
+	busyCPUFraction     = 0.9
+	busyGCPauseFraction = 0.1
+)
+
+// used to sample the resources the benchmark process uses while a
+// benchmark runs, so we can tell when the client, and not the server,
+// is the bottleneck
+type clientMonitor struct {
+	interval time.Duration
+	quit     chan bool
+	done     chan bool
+
+	// state as of the last sample
+	lastTime    time.Time
+	lastCPU     time.Duration
+	lastPauseNs uint64
+	lastNumGC   uint32
+	// the CPU time of each thread, by thread id, nil if unknown
+	lastThreadCPU map[int]time.Duration
+
+	// for the summary logged when the monitor is stopped
+	t0            time.Time
+	cpu0          time.Duration
+	pauseNs0      uint64
+	maxHeap       uint64
+	maxGoroutines int
+	maxThreadCPU  float64 // the most cores a single thread used in a sample
+	busySamples   int
+	numSamples    int
+}
+
+// starts a clientMonitor that samples every interval in a background thread
+func startClientMonitor(interval time.Duration) *clientMonitor {
+	m := &clientMonitor{interval: interval, quit: make(chan bool), done: make(chan bool)}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	m.t0 = time.Now()
+	m.cpu0 = processCPUTime()
+	m.pauseNs0 = mem.PauseTotalNs
+	m.lastTime, m.lastCPU, m.lastPauseNs, m.lastNumGC = m.t0, m.cpu0, mem.PauseTotalNs, mem.NumGC
+	m.lastThreadCPU = threadCPUTimes()
+	go m.loop()
+	return m
+}
+
+func (m *clientMonitor) loop() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			m.sample()
+		}
+	}
+}
+
+// returns the number of cores that were busy running this process, which used cpu
+// of CPU time over wall, e.g. 1.5 for one core and half of another
+func cpuCores(cpu time.Duration, wall time.Duration) float64 {
+	if wall <= 0 {
+		return 0
+	}
+	return float64(cpu) / float64(wall)
+}
+
+// returns the number of cores the busiest thread used over wall, given the CPU
+// time of each thread, by thread id, at its start (last) and end (curr)
+func busiestThread(last map[int]time.Duration, curr map[int]time.Duration, wall time.Duration) float64 {
+	var busiest float64
+	for tid, cpu := range curr {
+		// threads that are not in last started after it, so all their CPU time is within wall
+		if cores := cpuCores(cpu-last[tid], wall); cores > busiest {
+			busiest = cores
+		}
+	}
+	return busiest
+}
+
+func (m *clientMonitor) sample() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	now := time.Now()
+	cpu := processCPUTime()
+	goroutines := runtime.NumGoroutine()
+
+	wall := now.Sub(m.lastTime)
+	cores := cpuCores(cpu-m.lastCPU, wall)
+	numCores := runtime.GOMAXPROCS(0)
+	threadCPU := threadCPUTimes()
+	gcPause := float64(mem.PauseTotalNs-m.lastPauseNs) / float64(wall)
+	busiest := ""
+	threadCores := 0.0
+	if threadCPU != nil {
+		threadCores = busiestThread(m.lastThreadCPU, threadCPU, wall)
+		busiest = fmt.Sprintf(", busiest thread %.1f%% of a core", 100*threadCores)
+	}
+	log.Printf("client: cpu %.2f of %d cores%s, heap %dMB, gc cycles %d, gc pause %.1f%%, goroutines %d",
+		cores, numCores, busiest, mem.HeapAlloc>>20, mem.NumGC-m.lastNumGC, 100*gcPause, goroutines)
+	switch {
+	case cores > busyCPUFraction*float64(numCores):
+		log.Println("client: WARNING: the benchmark client is using all its cores and appears to be the bottleneck, results may not reflect the server")
+		m.busySamples++
+	case threadCores > busyCPUFraction:
+		log.Println("client: WARNING: a thread of the benchmark client is using a full core, so a single goroutine may be the bottleneck, results may not reflect the server")
+		m.busySamples++
+	case gcPause > busyGCPauseFraction:
+		log.Println("client: WARNING: the benchmark client spends its time in garbage collection and appears to be the bottleneck, results may not reflect the server")
+		m.busySamples++
+	case cores > busyCPUFraction:
+		// goroutines move between threads, so the busiest thread may not show it
+		log.Println("client: WARNING: the benchmark client is using a full core, if its work is done by a single goroutine, that goroutine may be the bottleneck")
+		m.busySamples++
+	}
+	if threadCores > m.maxThreadCPU {
+		m.maxThreadCPU = threadCores
+	}
+
+	m.numSamples++
+	if mem.HeapAlloc > m.maxHeap {
+		m.maxHeap = mem.HeapAlloc
+	}
+	if goroutines > m.maxGoroutines {
+		m.maxGoroutines = goroutines
+	}
+	m.lastTime, m.lastCPU, m.lastPauseNs, m.lastNumGC = now, cpu, mem.PauseTotalNs, mem.NumGC
+	m.lastThreadCPU = threadCPU
+}
+
+// stops sampling and logs a summary of the resources used since the monitor started
+func (m *clientMonitor) stop() {
+	close(m.quit)
+	<-m.done
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	wall := time.Since(m.t0)
+	log.Printf("client summary: cpu %.2f of %d cores, busiest thread %.1f%% of a core, max heap %dMB, gc pause %.1f%%, max goroutines %d",
+		cpuCores(processCPUTime()-m.cpu0, wall), runtime.GOMAXPROCS(0), 100*m.maxThreadCPU, m.maxHeap>>20,
+		100*float64(mem.PauseTotalNs-m.pauseNs0)/float64(wall), m.maxGoroutines)
+	if m.busySamples > 0 {
+		log.Printf("client summary: WARNING: the client appeared to be the bottleneck in %d of %d samples", m.busySamples, m.numSamples)
+	}
+}
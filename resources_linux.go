@@ -0,0 +1,55 @@
+package benchmark
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the unit of the CPU times of /proc, USER_HZ, which is 100 on all Linux platforms
+const clockTick = 10 * time.Millisecond
+
+// returns the user and system CPU time used so far by each thread of this process, by thread id
+func threadCPUTimes() map[int]time.Duration {
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return nil
+	}
+	ret := make(map[int]time.Duration, len(tasks))
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/self/task/" + task.Name() + "/stat")
+		if err != nil {
+			// the thread exited
+			continue
+		}
+		if cpu, ok := parseThreadCPUTime(string(stat)); ok {
+			ret[tid] = cpu
+		}
+	}
+	return ret
+}
+
+// returns the CPU time in stat, the contents of /proc/<pid>/task/<tid>/stat
+func parseThreadCPUTime(stat string) (time.Duration, bool) {
+	// the name of the thread, in parentheses, may contain spaces, so the fields are
+	// counted from its end, from the state, the 3rd field. utime and stime are the 14th and 15th
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 13 {
+		return 0, false
+	}
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, false
+	}
+	return time.Duration(utime+stime) * clockTick, true
+}
@@ -0,0 +1,29 @@
+package benchmark
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseThreadCPUTime(t *testing.T) {
+	tests := []struct {
+		stat string
+		want time.Duration
+		ok   bool
+	}{
+		{"1234 (bench) R 1 1234 1234 0 -1 4194304 100 0 0 0 250 30 0 0 20 0 8 0 100 0 0", 2800 * time.Millisecond, true},
+		// the name of a thread may contain spaces and parentheses
+		{"1234 (a (b) c) S 1 1234 1234 0 -1 4194304 100 0 0 0 7 3 0 0 20 0 8 0 100 0 0", 100 * time.Millisecond, true},
+		{"1234 (bench) R 1 1234", 0, false},
+		{"garbage", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseThreadCPUTime(test.stat)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseThreadCPUTime(%q) = %v, %v, want %v, %v", test.stat, got, ok, test.want, test.ok)
+		}
+	}
+	if threads := threadCPUTimes(); len(threads) == 0 {
+		t.Errorf("no threads found in /proc/self/task")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package benchmark
+
+import (
+	"time"
+)
+
+// the CPU time of each thread is only available on Linux, elsewhere
+// the busiest thread of the client is not reported
+func threadCPUTimes() map[int]time.Duration {
+	return nil
+}
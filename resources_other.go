@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package benchmark
+
+import (
+	"time"
+)
+
+// CPU time is not available on this platform, so the CPU usage of
+// the client is always reported as 0
+func processCPUTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,18 @@
+package benchmark
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBusiestThread(t *testing.T) {
+	last := map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 0}
+	curr := map[int]time.Duration{1: 1100 * time.Millisecond, 2: 2950 * time.Millisecond, 4: 500 * time.Millisecond}
+	// thread 2 used 950ms of the second, thread 4, which started during it, 500ms
+	if got := busiestThread(last, curr, time.Second); got < 0.949 || got > 0.951 {
+		t.Errorf("busiest thread used %g cores, want 0.95", got)
+	}
+	if got := busiestThread(nil, nil, time.Second); got != 0 {
+		t.Errorf("busiest of no threads used %g cores, want 0", got)
+	}
+}
@@ -0,0 +1,93 @@
+package benchmark
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Defines how Sweep increases the load on the server.
+type SweepOptions struct {
+	// The load level of the first phase. What a level means (a number of
+	// threads, a rate of operations, ...) is up to the function that makes the works
+	Start uint64
+	// The amount the level is increased by after each phase
+	Step uint64
+	// The level of the last phase, if the latency target is never exceeded
+	Max uint64
+	// How long each phase runs for
+	PhaseDuration time.Duration
+	// The p99 latency of Work.Do that the server must sustain. The sweep
+	// stops after the first phase whose p99 latency exceeds it
+	TargetP99 time.Duration
+}
+
+// The results of one phase of a sweep
+type SweepPoint struct {
+	Level      uint64
+	Throughput float64 // calls to Work.Do per second
+	P50        time.Duration
+	P99        time.Duration
+}
+
+// returns true if the point meets the latency target of the sweep
+func (p SweepPoint) sustainable(opts SweepOptions) bool {
+	return p.P99 <= opts.TargetP99
+}
+
+// Sweep finds the capacity of a server at a latency target. It runs successive
+// phases of opts.PhaseDuration, starting at load level opts.Start and increasing
+// by opts.Step, until the p99 latency of a phase exceeds opts.TargetP99 or the level
+// exceeds opts.Max. For each phase, makeWorks is called with the level to create the
+// works to run, which must be time based (MaxOps of 0), as in Run.
+//
+// Returns the throughput and latencies of every phase that ran, and the index in
+// that slice of the maximum sustainable point, which is the phase with the highest
+// throughput that met the latency target. The index is -1 if no phase met the target.
+func Sweep(metricSample interface{}, makeWorks func(level uint64) []WorkInfo, opts SweepOptions) (points []SweepPoint, best int) {
+	if opts.Step == 0 || opts.PhaseDuration <= 0 || opts.TargetP99 <= 0 {
+		log.Fatal("invalid sweep options ", opts, ", Step, PhaseDuration and TargetP99 must be > 0")
+	}
+	best = -1
+	for level := opts.Start; level <= opts.Max; level += opts.Step {
+		log.Println("sweep: starting phase at level ", level)
+		t0 := time.Now()
+		latencies := run(metricSample, makeWorks(level), opts.PhaseDuration)
+		point := SweepPoint{
+			Level:      level,
+			Throughput: float64(latencies.Count()) / time.Since(t0).Seconds(),
+			P50:        latencies.Percentile(50),
+			P99:        latencies.Percentile(99)}
+		log.Printf("sweep: level %d, throughput %.1f/s, p50 %v, p99 %v", point.Level, point.Throughput, point.P50, point.P99)
+		points = append(points, point)
+		if !point.sustainable(opts) {
+			log.Println("sweep: p99 latency ", point.P99, " exceeds target ", opts.TargetP99, ", stopping")
+			break
+		}
+		if best < 0 || point.Throughput > points[best].Throughput {
+			best = len(points) - 1
+		}
+	}
+	if best < 0 {
+		log.Println("sweep: no phase met the p99 latency target of ", opts.TargetP99)
+	} else {
+		log.Printf("sweep: max sustainable point is level %d, throughput %.1f/s, p99 %v", points[best].Level, points[best].Throughput, points[best].P99)
+	}
+	return points, best
+}
+
+// WriteSweepCSV writes the throughput-vs-latency curve of a sweep as CSV,
+// with one line per phase. The maximum sustainable point, at index best, is marked.
+func WriteSweepCSV(w io.Writer, points []SweepPoint, best int) error {
+	if _, err := fmt.Fprintln(w, "level,throughput,p50_us,p99_us,max_sustainable"); err != nil {
+		return err
+	}
+	for i, p := range points {
+		_, err := fmt.Fprintf(w, "%d,%.1f,%d,%d,%t\n", p.Level, p.Throughput, p.P50/time.Microsecond, p.P99/time.Microsecond, i == best)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}